@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/luojun96/isync/cts"
+	"github.com/luojun96/isync/registry"
+	"github.com/luojun96/isync/throttle"
+	"gopkg.in/yaml.v3"
+)
+
+// config defines the registries and sync jobs isync knows by name, in YAML
+// or JSON. The url, username and password of registries may refer to
+// environment variables as $VAR or ${VAR}, to keep secrets out of the file.
+type config struct {
+	Registries map[string]registryConfig `yaml:"registries"`
+	Jobs       []jobConfig               `yaml:"jobs"`
+	// Bandwidth limits all transfers, e.g. 10MB/s, unless --bandwidth-limit
+	// is given. The bandwidths are read again on SIGHUP.
+	Bandwidth string `yaml:"bandwidth"`
+
+	path string
+	// root is the parsed document, for the lines of errors
+	root *yaml.Node
+}
+
+type registryConfig struct {
+	URL             string `yaml:"url"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	CredentialsFile string `yaml:"credentials-file"`
+	// ChunkSize is a size such as 8MB, see throttle.ParseBytes
+	ChunkSize string `yaml:"chunk-size"`
+	// Limits are given as for registry.ParseLimits
+	Limits string `yaml:"limits"`
+	// Bandwidth limits the transfers to the registry, e.g. 10MB/s
+	Bandwidth string `yaml:"bandwidth"`
+}
+
+// jobConfig copies the images of a source registry to each of its
+// destinations. Registries are names of the config or URLs.
+type jobConfig struct {
+	Name        string `yaml:"name"`
+	Source      string `yaml:"source"`
+	Destination string `yaml:"destination"`
+	// Destinations are synced one after the other, after Destination
+	Destinations []string           `yaml:"destinations"`
+	Repositories []repositoryConfig `yaml:"repositories"`
+	Images       []string           `yaml:"images"`
+	ImagesFile   string             `yaml:"images-file"`
+	Catalog      *catalogConfig     `yaml:"catalog"`
+
+	Mappings          []mappingConfig `yaml:"mappings"`
+	Platforms         []string        `yaml:"platforms"`
+	Index             string          `yaml:"index"`
+	TagPolicy         string          `yaml:"tag-policy"`
+	StagingRepository string          `yaml:"staging-repository"`
+	ContinueOnError   bool            `yaml:"continue-on-error"`
+	DryRun            bool            `yaml:"dry-run"`
+	// MaxRepositories and MaxImages cap what a run pushes to each
+	// destination, see cts.WithMaxRepositories
+	MaxRepositories int `yaml:"max-repositories"`
+	MaxImages       int `yaml:"max-images"`
+}
+
+// mappingConfig renames images in the destination registries by one of
+// prefix, regex or table, see cts.PrefixMapping, cts.RegexMapping and
+// cts.TableMapping.
+type mappingConfig struct {
+	Prefix *string           `yaml:"prefix"`
+	Regex  string            `yaml:"regex"`
+	To     string            `yaml:"to"`
+	Table  map[string]string `yaml:"table"`
+}
+
+// repositoryConfig selects tags of a repository, those listed and those the
+// selectors select out of the tags of the source registry.
+type repositoryConfig struct {
+	Name string `yaml:"name"`
+	// Tags are tags or digests
+	Tags []string `yaml:"tags"`
+	// the selectors are given along with the name
+	tagSelectorConfig `yaml:",inline"`
+}
+
+// tagSelectorConfig selects tags out of the tags of the source registry, see
+// cts.TagSelector.
+type tagSelectorConfig struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	Glob    []string `yaml:"glob"`
+	Semver  string   `yaml:"semver"`
+	Latest  int      `yaml:"latest"`
+}
+
+// selector returns the tag selector, false when it has none.
+func (t tagSelectorConfig) selector() (cts.TagSelector, bool) {
+	s := cts.TagSelector{Include: t.Include, Exclude: t.Exclude, Globs: t.Glob, Semver: t.Semver, Latest: t.Latest}
+	return s, len(s.Include)+len(s.Exclude)+len(s.Globs) > 0 || s.Semver != "" || s.Latest != 0
+}
+
+// catalogConfig mirrors the repositories of the source registry its filter
+// selects, with the tags its selector selects, all of them by default.
+type catalogConfig struct {
+	// Prefixes are namespaces such as library
+	Prefixes []string `yaml:"prefixes"`
+	// Include and Exclude are regular expressions matching whole repositories
+	Include []string          `yaml:"include"`
+	Exclude []string          `yaml:"exclude"`
+	Tags    tagSelectorConfig `yaml:"tags"`
+}
+
+func (c catalogConfig) filter() cts.RepositoryFilter {
+	return cts.RepositoryFilter{Prefixes: c.Prefixes, Include: c.Include, Exclude: c.Exclude}
+}
+
+// yamlLine matches the line yaml reports errors at.
+var yamlLine = regexp.MustCompile(`(?:yaml: )?line (\d+): `)
+
+func loadConfig(path string) (*config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	c := &config{path: path, root: &yaml.Node{}}
+	if err := yaml.Unmarshal(content, c.root); err != nil {
+		return nil, c.yamlError(err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, c.yamlError(err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(path)
+	for name, r := range c.Registries {
+		r.URL, r.Username, r.Password = expandEnv(r.URL), expandEnv(r.Username), expandEnv(r.Password)
+		r.CredentialsFile = resolvePath(dir, r.CredentialsFile)
+		c.Registries[name] = r
+	}
+	for i := range c.Jobs {
+		c.Jobs[i].ImagesFile = resolvePath(dir, c.Jobs[i].ImagesFile)
+	}
+	return c, nil
+}
+
+// envRef matches a reference to an environment variable, $VAR or ${VAR}.
+var envRef = regexp.MustCompile(`\$(?:\{[A-Za-z_][A-Za-z0-9_]*\}|[A-Za-z_][A-Za-z0-9_]*)`)
+
+// expandEnv replaces the references to environment variables in s. The
+// references to variables that are not set are kept, like any other $, so
+// that values such as passwords may contain them.
+func expandEnv(s string) string {
+	return envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		if value, ok := os.LookupEnv(strings.Trim(ref, "${}")); ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// resolvePath resolves a path of the config relative to its directory.
+func resolvePath(dir string, path string) string {
+	if path == "" || path == "-" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// yamlError prefixes the errors of yaml with the path of the config, an
+// error per line.
+func (c *config) yamlError(err error) error {
+	var typeErr *yaml.TypeError
+	messages := []string{err.Error()}
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+	var errs []error
+	for _, message := range messages {
+		errs = append(errs, errors.New(yamlLine.ReplaceAllString(message, c.path+":$1: ")))
+	}
+	return errors.Join(errs...)
+}
+
+// at is the path of a value in the config, made of mapping keys and sequence
+// indexes.
+type at []any
+
+// line returns the line of the value at path, or of its deepest ancestor in
+// the config when it is missing.
+func (c *config) line(path at) int {
+	node := c.root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, step := range path {
+		var next *yaml.Node
+		switch step := step.(type) {
+		case string:
+			for i := 0; node.Kind == yaml.MappingNode && i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == step {
+					next = node.Content[i+1]
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && step < len(node.Content) {
+				next = node.Content[step]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
+
+// validate checks the whole config, reporting every invalid value with its
+// line.
+func (c *config) validate() error {
+	var errs []error
+	errorf := func(path at, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s:%d: %s", c.path, c.line(path), fmt.Sprintf(format, args...)))
+	}
+
+	if _, err := parseSize(c.Bandwidth); err != nil {
+		errorf(at{"bandwidth"}, "invalid bandwidth: %v", err)
+	}
+
+	names := make([]string, 0, len(c.Registries))
+	for name := range c.Registries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := c.Registries[name]
+		if r.URL == "" {
+			errorf(at{"registries", name}, "registry %s has no url", name)
+		}
+		if _, err := parseSize(r.ChunkSize); err != nil {
+			errorf(at{"registries", name, "chunk-size"}, "registry %s: invalid chunk-size: %v", name, err)
+		}
+		if r.Limits != "" {
+			if _, err := registry.ParseLimits(r.Limits); err != nil {
+				errorf(at{"registries", name, "limits"}, "registry %s: %v", name, err)
+			}
+		}
+		if _, err := parseSize(r.Bandwidth); err != nil {
+			errorf(at{"registries", name, "bandwidth"}, "registry %s: invalid bandwidth: %v", name, err)
+		}
+	}
+
+	jobs := make(map[string]bool)
+	for i, job := range c.Jobs {
+		name := job.Name
+		switch {
+		case name == "":
+			name = fmt.Sprint(i + 1)
+			errorf(at{"jobs", i}, "job %s has no name", name)
+		case jobs[name]:
+			errorf(at{"jobs", i, "name"}, "job %s is defined twice", name)
+		}
+		jobs[name] = true
+
+		if job.Source == "" {
+			errorf(at{"jobs", i}, "job %s has no source", name)
+		} else if !c.knows(job.Source) {
+			errorf(at{"jobs", i, "source"}, "job %s: unknown registry %s", name, job.Source)
+		}
+		if job.Destination == "" && len(job.Destinations) == 0 {
+			errorf(at{"jobs", i}, "job %s has no destination", name)
+		}
+		if job.Destination != "" && !c.knows(job.Destination) {
+			errorf(at{"jobs", i, "destination"}, "job %s: unknown registry %s", name, job.Destination)
+		}
+		for j, dst := range job.Destinations {
+			if !c.knows(dst) {
+				errorf(at{"jobs", i, "destinations", j}, "job %s: unknown registry %s", name, dst)
+			}
+		}
+
+		if len(job.Images) == 0 && job.ImagesFile == "" && len(job.Repositories) == 0 && job.Catalog == nil {
+			errorf(at{"jobs", i}, "job %s has no images, images-file, repositories or catalog", name)
+		}
+		for j, repo := range job.Repositories {
+			if repo.Name == "" {
+				errorf(at{"jobs", i, "repositories", j}, "job %s: repository has no name", name)
+			}
+			selector, ok := repo.selector()
+			if len(repo.Tags) == 0 && !ok {
+				errorf(at{"jobs", i, "repositories", j}, "job %s: repository %s has no tags or tag selectors", name, repo.Name)
+			}
+			if err := selector.Validate(); err != nil {
+				errorf(at{"jobs", i, "repositories", j}, "job %s: repository %s: %v", name, repo.Name, err)
+			}
+		}
+		if job.Catalog != nil {
+			if err := job.Catalog.filter().Validate(); err != nil {
+				errorf(at{"jobs", i, "catalog"}, "job %s: catalog: %v", name, err)
+			}
+			selector, _ := job.Catalog.Tags.selector()
+			if err := selector.Validate(); err != nil {
+				errorf(at{"jobs", i, "catalog", "tags"}, "job %s: catalog: %v", name, err)
+			}
+		}
+		if job.MaxRepositories < 0 {
+			errorf(at{"jobs", i, "max-repositories"}, "job %s: invalid max-repositories %d", name, job.MaxRepositories)
+		}
+		if job.MaxImages < 0 {
+			errorf(at{"jobs", i, "max-images"}, "job %s: invalid max-images %d", name, job.MaxImages)
+		}
+		for j, m := range job.Mappings {
+			if _, err := m.mapping(); err != nil {
+				errorf(at{"jobs", i, "mappings", j}, "job %s: %v", name, err)
+			}
+		}
+		for j, platform := range job.Platforms {
+			if _, err := cts.ParsePlatform(platform); err != nil {
+				errorf(at{"jobs", i, "platforms", j}, "job %s: %v", name, err)
+			}
+		}
+		if job.Index != "" {
+			if _, err := cts.ParseIndexPolicy(job.Index); err != nil {
+				errorf(at{"jobs", i, "index"}, "job %s: %v", name, err)
+			}
+		}
+		if job.TagPolicy != "" {
+			if _, err := cts.ParseTagPolicy(job.TagPolicy); err != nil {
+				errorf(at{"jobs", i, "tag-policy"}, "job %s: %v", name, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// knows reports whether name is a registry of the config or a URL.
+func (c *config) knows(name string) bool {
+	_, ok := c.Registries[name]
+	return ok || strings.Contains(name, "://")
+}
+
+func (c *config) job(name string) (jobConfig, error) {
+	for _, job := range c.Jobs {
+		if job.Name == name {
+			return job, nil
+		}
+	}
+	return jobConfig{}, fmt.Errorf("job %s is not defined in the config", name)
+}
+
+// registry returns the registry named name, or a registry of the URL name
+// when there is none of that name.
+func (c *config) registry(name string) registryConfig {
+	if r, ok := c.Registries[name]; ok {
+		return r
+	}
+	return registryConfig{URL: name}
+}
+
+// destinations returns Destination followed by Destinations.
+func (j jobConfig) destinations() []string {
+	if j.Destination == "" {
+		return j.Destinations
+	}
+	return append([]string{j.Destination}, j.Destinations...)
+}
+
+func (m mappingConfig) mapping() (cts.Mapping, error) {
+	kinds := 0
+	for _, set := range []bool{m.Prefix != nil, m.Regex != "", m.Table != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return nil, fmt.Errorf("mapping has to be one of prefix, regex or table")
+	}
+	switch {
+	case m.Prefix != nil:
+		return cts.PrefixMapping{From: *m.Prefix, To: m.To}, nil
+	case m.Regex != "" && m.To == "":
+		return nil, fmt.Errorf("regex mapping has no to")
+	case m.Regex != "":
+		return cts.NewRegexMapping(m.Regex, m.To)
+	case m.To != "":
+		return nil, fmt.Errorf("table mapping takes no to")
+	}
+	return cts.TableMapping(m.Table), nil
+}
+
+// parseSize parses an optional size, empty is zero.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return throttle.ParseBytes(s)
+}
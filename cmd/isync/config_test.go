@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config into a temporary directory and returns its
+// path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "isync.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("ISYNC_HOST", "registry.example.com")
+	t.Setenv("ISYNC_USER", "ci")
+	t.Setenv("ISYNC_PASSWORD", "abc: def")
+	t.Setenv("ns", "expanded")
+
+	c, err := loadConfig(writeConfig(t, `
+registries:
+  source:
+    url: https://${ISYNC_HOST}
+    username: $ISYNC_USER
+    password: ${ISYNC_PASSWORD}
+  mirror:
+    url: http://mirror:5000
+    password: "pa$$word"
+  literal:
+    url: http://$ISYNC_UNSET:5000
+    password: "pa$ns"
+jobs:
+  - name: mirror
+    source: source
+    destination: mirror
+    images: [library/nginx:1.25]
+    mappings:
+      - regex: '(?P<ns>[^/]+)/(.+)'
+        to: 'mirror/${ns}/$2'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{c.Registries["source"].URL, "https://registry.example.com"},
+		{c.Registries["source"].Username, "ci"},
+		{c.Registries["source"].Password, "abc: def"},
+		{c.Registries["mirror"].Password, "pa$$word"},
+		{c.Registries["literal"].URL, "http://$ISYNC_UNSET:5000"},
+		{c.Registries["literal"].Password, "paexpanded"},
+		// patterns and mappings are never expanded
+		{c.Jobs[0].Mappings[0].Regex, "(?P<ns>[^/]+)/(.+)"},
+		{c.Jobs[0].Mappings[0].To, "mirror/${ns}/$2"},
+	}
+	for i, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("value %d = %q, want %q", i, tt.got, tt.want)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("ISYNC_A", "a")
+	t.Setenv("ISYNC_EMPTY", "")
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"$ISYNC_A", "a"},
+		{"${ISYNC_A}b", "ab"},
+		{"$ISYNC_Ab", "$ISYNC_Ab"},
+		{"x${ISYNC_EMPTY}y", "xy"},
+		{"$ISYNC_UNSET", "$ISYNC_UNSET"},
+		{"$", "$"},
+		{"$1 ${1} $$", "$1 ${1} $$"},
+		{"${ISYNC_A", "${ISYNC_A"},
+	}
+	for _, tt := range tests {
+		if got := expandEnv(tt.in); got != tt.want {
+			t.Errorf("expandEnv(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		// want are the errors, prefixed with the path of the config
+		want []string
+	}{
+		{
+			"yaml syntax",
+			"registries:\n  source:\n    url: [\n",
+			[]string{":3: did not find expected node content"},
+		},
+		{
+			"unknown field",
+			"registries:\n  source:\n    url: http://source\n    user: ci\n",
+			[]string{":4: field user not found in type main.registryConfig"},
+		},
+		{
+			"wrong type",
+			"jobs:\n  - name: a\n    max-images: many\n",
+			[]string{":3: cannot unmarshal !!str `many` into int"},
+		},
+		{
+			"invalid values",
+			`bandwidth: fast
+registries:
+  mirror:
+    url: http://mirror:5000
+    chunk-size: 8XB
+    limits: uploads=2
+  nourl:
+    chunk-size: 8MB
+jobs:
+  - name: mirror
+    source: source
+    destinations: [mirror, backup]
+    images: [library/nginx:1.25]
+    platforms: [linux/amd64, linux]
+    index: keep
+    tag-policy: maybe
+    mappings:
+      - prefix: library
+        regex: library
+  - name: mirror
+    destination: mirror
+    max-images: -1
+`,
+			[]string{
+				":1: invalid bandwidth",
+				":5: registry mirror: invalid chunk-size",
+				":6: registry mirror: invalid limit",
+				":8: registry nourl has no url",
+				":11: job mirror: unknown registry source",
+				":12: job mirror: unknown registry backup",
+				":18: job mirror: mapping has to be one of prefix, regex or table",
+				":14: job mirror: invalid platform",
+				":15: job mirror: invalid index policy",
+				":16: job mirror: invalid tag policy",
+				":20: job mirror is defined twice",
+				":20: job mirror has no source",
+				":20: job mirror has no images, images-file, repositories or catalog",
+				":22: job mirror: invalid max-images -1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.content)
+			_, err := loadConfig(path)
+			if err == nil {
+				t.Fatal("loaded an invalid config")
+			}
+			got := strings.Split(err.Error(), "\n")
+			if len(got) != len(tt.want) {
+				t.Fatalf("%d errors, want %d:\n%v", len(got), len(tt.want), err)
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(got[i], path+want) {
+					t.Errorf("error %d = %q, want %q", i, got[i], path+want)
+				}
+			}
+		})
+	}
+}
@@ -1,35 +1,152 @@
 package main
 
 import (
-	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/luojun96/isync/cts"
+	"github.com/luojun96/isync/progress"
 	"github.com/luojun96/isync/registry"
 )
 
+const usage = `Usage: isync [global flags] <command> [flags]
+
+Commands:
+  sync    copy images from a source registry to a destination registry
+  help    show this help
+
+Run 'isync <command> -h' for the flags of a command.
+
+Global flags, which can also be given after the command:
+`
+
+// globalOptions are the flags every command accepts.
+type globalOptions struct {
+	config         string
+	concurrency    int
+	logLevel       string
+	timeout        time.Duration
+	requestTimeout time.Duration
+	progress       string
+}
+
+// register adds the global flags to fs, with their current values as
+// defaults so that flags given before the command are kept.
+func (g *globalOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.config, "config", g.config, "YAML config defining registries and sync jobs")
+	fs.IntVar(&g.concurrency, "concurrency", g.concurrency, "images and layer uploads in flight at once")
+	fs.StringVar(&g.logLevel, "log-level", g.logLevel, "debug, info or error")
+	fs.DurationVar(&g.timeout, "timeout", g.timeout, "time limit of the whole command, 0 for none")
+	fs.DurationVar(&g.requestTimeout, "request-timeout", g.requestTimeout, "time a registry may take to answer a request, 0 for none")
+	fs.StringVar(&g.progress, "progress", g.progress, "auto, tty, json or none")
+}
+
 func main() {
-	ctx := context.Background()
+	global := &globalOptions{
+		concurrency: cts.Concurrency,
+		logLevel:    "info",
+		progress:    "auto",
+	}
+	fs := flag.NewFlagSet("isync", flag.ContinueOnError)
+	global.register(fs)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, os.Args[1:]); err != nil {
+		exit(err)
+	}
 
-	artifacts := os.Getenv("ARTIFACTS")
-	if artifacts == "" {
-		log.Fatal("No artifacts to be pushed.")
+	var err error
+	switch command := fs.Arg(0); command {
+	case "sync":
+		err = runSync(global, fs.Args()[1:])
+	case "help":
+		fs.SetOutput(os.Stdout)
+		fs.Usage()
+	case "":
+		fs.Usage()
+		err = errUsage
+	default:
+		err = fmt.Errorf("unknown command %q, run 'isync help' for usage", command)
 	}
+	exit(err)
+}
+
+// errUsage is returned for invalid flags, which the flag package reported
+// already.
+var errUsage = errors.New("invalid usage")
+
+func exit(err error) {
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		os.Exit(0)
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	}
+	fmt.Fprintf(os.Stderr, "isync: %v\n", err)
+	os.Exit(1)
+}
 
-	sr := registry.NewRegistry("https://registry.jun.com/")
-	if err := sr.Ping(); err != nil {
-		log.Fatal(fmt.Errorf("failed to ping source registry: %v", err))
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
 	}
+	return nil
+}
 
-	dr := registry.NewRegistry("http://aliyun:5000/")
-	if err := dr.Ping(); err != nil {
-		log.Fatal(fmt.Errorf("failed to ping destination registry: %v", err))
+// setup directs the log to the renderer of the progress, unless the log
+// level is error, and returns the renderer, nil when the progress is not
+// rendered. The requests of the registry clients are logged at debug only,
+// see registryOptions.
+func (g *globalOptions) setup() (progress.Renderer, error) {
+	switch g.logLevel {
+	case "debug", "info", "error":
+	default:
+		return nil, fmt.Errorf("invalid log level %q, expected debug, info or error", g.logLevel)
 	}
 
-	if err := cts.NewImageSync(sr, dr).Sync(ctx, strings.Split(artifacts, ",")); err != nil {
-		log.Fatal(fmt.Errorf("failed to sync images: %v", err))
+	mode := g.progress
+	if mode == "auto" {
+		mode = "json"
+		if progress.IsTerminal(os.Stderr) {
+			mode = "tty"
+		}
+	}
+	var out io.Writer = os.Stderr
+	var renderer progress.Renderer
+	switch mode {
+	case "tty":
+		tty := progress.NewTTY(os.Stderr)
+		out, renderer = tty, tty
+	case "json":
+		renderer = progress.NewJSON(os.Stderr)
+	case "none":
+	default:
+		return nil, fmt.Errorf("invalid progress %q, expected auto, tty, json or none", g.progress)
+	}
+	// the failures are reported once the command is done
+	if g.logLevel == "error" {
+		out = io.Discard
+	}
+	log.SetOutput(out)
+	return renderer, nil
+}
+
+// registryOptions returns the options of the registry clients set by the
+// global flags, debug logs every request the clients send.
+func (g *globalOptions) registryOptions() []registry.Option {
+	opts := []registry.Option{registry.WithTimeout(g.requestTimeout)}
+	if g.logLevel == "debug" {
+		opts = append(opts, registry.WithDebugLog(log.Default()))
 	}
+	return opts
 }
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/luojun96/isync/cts"
+	"github.com/luojun96/isync/progress"
+	"github.com/luojun96/isync/registry"
+	"github.com/luojun96/isync/throttle"
+)
+
+const syncUsage = `Usage: isync sync [flags] [image...]
+
+Copies images, given as repository:tag or repository@digest, from the source
+registry to the destination registries. --src and --dst take URLs or names of
+registries of the config. --namespace mirrors every repository under the
+namespaces instead, listed by the catalog of the source registry.
+
+With a config, the jobs given by --job run, or all jobs when neither --job,
+registries nor images are given. The flags given along override the jobs.
+
+Flags:
+`
+
+type syncOptions struct {
+	src               string
+	dst               string
+	images            string
+	imagesFile        string
+	jobs              string
+	platforms         string
+	index             string
+	tagPolicy         string
+	stagingRepository string
+	mappings          string
+	chunkSize         string
+	continueOnError   bool
+	bandwidth         string
+	srcLimits         string
+	dstLimits         string
+	credentialsFile   string
+	namespaces        string
+	maxRepositories   int
+	maxImages         int
+	dryRun            bool
+}
+
+func runSync(global *globalOptions, args []string) error {
+	opts := &syncOptions{}
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	global.register(fs)
+	fs.StringVar(&opts.src, "src", "", "source registry")
+	fs.StringVar(&opts.dst, "dst", "", "comma separated destination registries")
+	fs.StringVar(&opts.images, "images", "", "comma separated images")
+	fs.StringVar(&opts.imagesFile, "images-file", "", "file listing an image per line, - for stdin")
+	fs.StringVar(&opts.namespaces, "namespace", "", "comma separated namespaces of the source registry to mirror all repositories and tags of")
+	fs.IntVar(&opts.maxRepositories, "max-repositories", 0, "repositories to push images to in each destination per run, 0 for all")
+	fs.IntVar(&opts.maxImages, "max-images", 0, "images to push to each destination per run, 0 for all")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "list the images that would be copied without copying them")
+	fs.StringVar(&opts.jobs, "job", "", "comma separated jobs of the config to run")
+	fs.StringVar(&opts.platforms, "platforms", "", "comma separated platforms to copy of multi-platform images, e.g. linux/amd64,linux/arm64")
+	fs.StringVar(&opts.index, "index", "", "reduce the indexes of multi-platform images to the platforms, or copy them in full")
+	fs.StringVar(&opts.tagPolicy, "tag-policy", "", "overwrite, skip or fail on tags that differ in the destination registry")
+	fs.StringVar(&opts.stagingRepository, "staging-repository", "", "destination repository to mount blobs from, and to upload them to first")
+	fs.StringVar(&opts.mappings, "map", "", "comma separated prefix mappings of repositories, e.g. library=mirror/dockerhub")
+	fs.StringVar(&opts.chunkSize, "chunk-size", "", "upload blobs in resumable chunks of this size, e.g. 8MB")
+	fs.BoolVar(&opts.continueOnError, "continue-on-error", false, "sync the other images when one fails")
+	fs.StringVar(&opts.bandwidth, "bandwidth-limit", "", "bandwidth of all transfers, e.g. 10MB/s, instead of the bandwidth of the config")
+	fs.StringVar(&opts.srcLimits, "src-limits", "", "concurrent requests to the source registry, e.g. manifests=4,heads=16,transfers=2,adaptive")
+	fs.StringVar(&opts.dstLimits, "dst-limits", "", "concurrent requests to the destination registries")
+	fs.StringVar(&opts.credentialsFile, "credentials-file", "", "isync credentials file of the registries")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), syncUsage)
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	cfg := &config{}
+	if global.config != "" {
+		var err error
+		if cfg, err = loadConfig(global.config); err != nil {
+			return err
+		}
+	}
+	jobs, err := opts.selectJobs(cfg, fs.Args())
+	if err != nil {
+		return err
+	}
+	bandwidth, err := parseSize(opts.bandwidth)
+	if err != nil {
+		return fmt.Errorf("invalid bandwidth limit: %w", err)
+	}
+	if opts.bandwidth == "" {
+		bandwidth, _ = parseSize(cfg.Bandwidth)
+	}
+	renderer, err := global.setup()
+	if err != nil {
+		return err
+	}
+
+	s := &syncer{
+		global:   global,
+		opts:     opts,
+		cfg:      cfg,
+		renderer: renderer,
+		clients:  make(map[string]*client),
+		// the limiters exist without limits too, to take those set on SIGHUP
+		bandwidth: throttle.NewLimiter("global", bandwidth),
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if global.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, global.timeout)
+		defer cancel()
+	}
+	go s.reloadOnHangup(ctx)
+
+	var errs []error
+	for _, job := range jobs {
+		// the images are read once, an images file may be stdin
+		images, err := s.images(ctx, job)
+		if err == nil && len(images) == 0 {
+			err = fmt.Errorf("no images to sync")
+		}
+		if err != nil {
+			label := job.label(strings.Join(job.destinations(), ", "))
+			errs = append(errs, fmt.Errorf("%s: %w", label, err))
+			if !job.ContinueOnError || len(images) == 0 {
+				continue
+			}
+			log.Printf("%s: %v, syncing the %d other images.\n", label, err, len(images))
+		}
+		for _, dst := range job.destinations() {
+			if ctx.Err() != nil {
+				return errors.Join(append(errs, ctx.Err())...)
+			}
+			if err := s.run(ctx, job, dst, images); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", job.label(dst), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// selectJobs returns the jobs of the config given by --job, or all of them.
+// Without jobs, or with registries or images given by flags, the flags make
+// up a single job.
+func (o *syncOptions) selectJobs(cfg *config, args []string) ([]jobConfig, error) {
+	var jobs []jobConfig
+	switch {
+	case o.jobs != "":
+		for _, name := range splitList(o.jobs) {
+			job, err := cfg.job(name)
+			if err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, job)
+		}
+	case o.src != "" || o.dst != "" || o.images != "" || o.imagesFile != "" || o.namespaces != "" || len(args) > 0 || len(cfg.Jobs) == 0:
+		jobs = []jobConfig{{}}
+	default:
+		jobs = append(jobs, cfg.Jobs...)
+	}
+
+	var mappings []mappingConfig
+	for _, m := range splitList(o.mappings) {
+		from, to, ok := strings.Cut(m, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mapping %q, expected from=to", m)
+		}
+		mappings = append(mappings, mappingConfig{Prefix: &from, To: to})
+	}
+	if o.maxRepositories < 0 || o.maxImages < 0 {
+		return nil, fmt.Errorf("invalid max-repositories or max-images, expected a positive number")
+	}
+	for i := range jobs {
+		o.apply(&jobs[i], mappings, args)
+		if jobs[i].Source == "" || len(jobs[i].destinations()) == 0 {
+			return nil, fmt.Errorf("no source or destination registry, give --src and --dst or --job")
+		}
+	}
+	return jobs, nil
+}
+
+// apply overrides the job with the flags, images and namespaces given by
+// flags or as arguments replace the images of the job.
+func (o *syncOptions) apply(job *jobConfig, mappings []mappingConfig, args []string) {
+	for _, override := range []struct {
+		field *string
+		value string
+	}{
+		{&job.Source, o.src},
+		{&job.Index, o.index},
+		{&job.TagPolicy, o.tagPolicy},
+		{&job.StagingRepository, o.stagingRepository},
+	} {
+		if override.value != "" {
+			*override.field = override.value
+		}
+	}
+	if o.dst != "" {
+		job.Destination, job.Destinations = "", splitList(o.dst)
+	}
+	if len(mappings) > 0 {
+		job.Mappings = mappings
+	}
+	if o.platforms != "" {
+		job.Platforms = splitList(o.platforms)
+	}
+	job.ContinueOnError = job.ContinueOnError || o.continueOnError
+	job.DryRun = job.DryRun || o.dryRun
+	if o.maxRepositories > 0 {
+		job.MaxRepositories = o.maxRepositories
+	}
+	if o.maxImages > 0 {
+		job.MaxImages = o.maxImages
+	}
+
+	if o.images != "" || o.imagesFile != "" || o.namespaces != "" || len(args) > 0 {
+		job.Images = append(splitList(o.images), args...)
+		job.ImagesFile = o.imagesFile
+		job.Repositories, job.Catalog = nil, nil
+	}
+	if o.namespaces != "" {
+		job.Catalog = &catalogConfig{Prefixes: splitList(o.namespaces)}
+	}
+}
+
+// syncer runs jobs, sharing the clients of the registries between them so
+// that their limits hold across the jobs.
+type syncer struct {
+	global   *globalOptions
+	opts     *syncOptions
+	cfg      *config
+	renderer progress.Renderer
+	// bandwidth limits all transfers
+	bandwidth *throttle.Limiter
+
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+type client struct {
+	name      string
+	registry  registry.Registry
+	bandwidth *throttle.Limiter
+}
+
+// reloadOnHangup sets the bandwidth limits to those of the config whenever
+// the process receives SIGHUP, until ctx is done.
+func (s *syncer) reloadOnHangup(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-hangup:
+			s.reloadBandwidth()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reloadBandwidth reads the config again and sets the limits of the global
+// and the destination limiters to its bandwidths, the running transfers
+// included. --bandwidth-limit keeps the global limit.
+func (s *syncer) reloadBandwidth() {
+	if s.global.config == "" {
+		log.Printf("no config to reload the bandwidth from.\n")
+		return
+	}
+	cfg, err := loadConfig(s.global.config)
+	if err != nil {
+		log.Printf("failed to reload the bandwidth: %v\n", err)
+		return
+	}
+	if s.opts.bandwidth == "" {
+		limit, _ := parseSize(cfg.Bandwidth)
+		setBandwidth(s.bandwidth, limit)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, c := range s.clients {
+		if strings.HasPrefix(key, "destination ") {
+			limit, _ := parseSize(cfg.registry(c.name).Bandwidth)
+			setBandwidth(c.bandwidth, limit)
+		}
+	}
+}
+
+func setBandwidth(l *throttle.Limiter, limit int64) {
+	if l.Limit() == limit {
+		return
+	}
+	l.SetLimit(limit)
+	if limit == 0 {
+		log.Printf("bandwidth of %s is not limited anymore.\n", l.Name())
+		return
+	}
+	log.Printf("bandwidth of %s is limited to %s/s.\n", l.Name(), throttle.FormatBytes(limit))
+}
+
+// run syncs the images of a job to one of its destinations.
+func (s *syncer) run(ctx context.Context, job jobConfig, dst string, images []string) error {
+	opts, err := job.options()
+	if err != nil {
+		return err
+	}
+	src, err := s.client(job.Source, false)
+	if err != nil {
+		return err
+	}
+	dest, err := s.client(dst, true)
+	if err != nil {
+		return err
+	}
+
+	bandwidth := []*throttle.Limiter{s.bandwidth, dest.bandwidth}
+	tracker := progress.NewTracker(bandwidth...)
+	opts = append(opts,
+		cts.WithConcurrency(s.global.concurrency),
+		cts.WithBandwidth(bandwidth...),
+		cts.WithProgress(tracker),
+	)
+	stop := func() {}
+	if s.renderer != nil {
+		stop = progress.Start(tracker, s.renderer, time.Second)
+	}
+	report, err := cts.NewImageSync(src.registry, dest.registry, opts...).Sync(ctx, images)
+	stop()
+	for _, result := range report.Images {
+		if result.Status == cts.StatusPlanned {
+			fmt.Printf("%s: would copy %s to %s\n", job.label(dst), result.Image, result.Destination)
+		}
+	}
+	fmt.Printf("%s: %s\n", job.label(dst), report)
+	if err != nil {
+		return fmt.Errorf("%d of %d images not synced", report.Count(cts.StatusFailed)+report.Count(cts.StatusCanceled), len(report.Images))
+	}
+	return nil
+}
+
+// client returns the client of the registry name, creating and pinging it
+// the first time. The flags of the destination registries apply when
+// destination is set.
+func (s *syncer) client(name string, destination bool) (*client, error) {
+	key := "source " + name
+	if destination {
+		key = "destination " + name
+	}
+	s.mu.Lock()
+	c, ok := s.clients[key]
+	s.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	r := s.cfg.registry(name)
+	if !destination && s.opts.srcLimits != "" {
+		r.Limits = s.opts.srcLimits
+	}
+	if destination && s.opts.dstLimits != "" {
+		r.Limits = s.opts.dstLimits
+	}
+	if destination && s.opts.chunkSize != "" {
+		r.ChunkSize = s.opts.chunkSize
+	}
+	if r.CredentialsFile == "" {
+		r.CredentialsFile = s.opts.credentialsFile
+	}
+	c, err := newClient(name, r, s.global.registryOptions()...)
+	if err != nil {
+		return nil, fmt.Errorf("registry %s: %w", name, err)
+	}
+	if err := c.registry.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to ping registry %s: %w", name, err)
+	}
+	s.mu.Lock()
+	s.clients[key] = c
+	s.mu.Unlock()
+	return c, nil
+}
+
+func newClient(name string, r registryConfig, opts ...registry.Option) (*client, error) {
+	if r.Username != "" || r.Password != "" {
+		opts = append(opts, registry.WithCredential(r.Username, r.Password))
+	}
+	if r.CredentialsFile != "" {
+		opts = append(opts, registry.WithCredentialsFile(r.CredentialsFile))
+	}
+	chunkSize, err := parseSize(r.ChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk size: %w", err)
+	}
+	if chunkSize > 0 {
+		opts = append(opts, registry.WithChunkSize(chunkSize))
+	}
+	if r.Limits != "" {
+		limits, err := registry.ParseLimits(r.Limits)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, registry.WithLimits(limits))
+	}
+	bandwidth, err := parseSize(r.Bandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bandwidth: %w", err)
+	}
+	c := &client{name: name, bandwidth: throttle.NewLimiter(name, bandwidth)}
+	c.registry = registry.NewRegistry(r.URL, opts...)
+	return c, nil
+}
+
+// label names the sync of the job to dst in the output.
+func (j jobConfig) label(dst string) string {
+	if j.Name == "" {
+		return dst
+	}
+	return fmt.Sprintf("job %s to %s", j.Name, dst)
+}
+
+func (j jobConfig) options() ([]cts.Option, error) {
+	var opts []cts.Option
+	for _, m := range j.Mappings {
+		mapping, err := m.mapping()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, cts.WithMappings(mapping))
+	}
+	if len(j.Platforms) > 0 {
+		var platforms []cts.Platform
+		for _, platform := range j.Platforms {
+			p, err := cts.ParsePlatform(platform)
+			if err != nil {
+				return nil, err
+			}
+			platforms = append(platforms, p)
+		}
+		policy := cts.ReduceIndex
+		if j.Index != "" {
+			var err error
+			if policy, err = cts.ParseIndexPolicy(j.Index); err != nil {
+				return nil, err
+			}
+		}
+		opts = append(opts, cts.WithPlatforms(policy, platforms...))
+	}
+	if j.TagPolicy != "" {
+		policy, err := cts.ParseTagPolicy(j.TagPolicy)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, cts.WithTagPolicy(policy))
+	}
+	if j.StagingRepository != "" {
+		opts = append(opts, cts.WithStagingRepository(j.StagingRepository))
+	}
+	if j.ContinueOnError {
+		opts = append(opts, cts.WithContinueOnError())
+	}
+	if j.DryRun {
+		opts = append(opts, cts.WithDryRun())
+	}
+	if j.MaxRepositories > 0 {
+		opts = append(opts, cts.WithMaxRepositories(j.MaxRepositories))
+	}
+	if j.MaxImages > 0 {
+		opts = append(opts, cts.WithMaxImages(j.MaxImages))
+	}
+	return opts, nil
+}
+
+// images returns the images of the job, followed by the tags of its
+// repositories, listed or selected out of the source registry, the tags of
+// the repositories of its catalog, and the images of its images file. With
+// continue-on-error, the repositories of the catalog whose tags cannot be
+// listed are left out, the images are returned along with their errors.
+func (s *syncer) images(ctx context.Context, job jobConfig) ([]string, error) {
+	var listErr error
+	images := append([]string{}, job.Images...)
+	var selectors []cts.RepositorySelector
+	for _, repo := range job.Repositories {
+		for _, tag := range repo.Tags {
+			if strings.Contains(tag, ":") {
+				images = append(images, repo.Name+"@"+tag)
+			} else {
+				images = append(images, repo.Name+":"+tag)
+			}
+		}
+		if selector, ok := repo.selector(); ok {
+			selectors = append(selectors, cts.RepositorySelector{Repository: repo.Name, Tags: selector})
+		}
+	}
+	if len(selectors) > 0 {
+		src, err := s.client(job.Source, false)
+		if err != nil {
+			return nil, err
+		}
+		selected, err := cts.ExpandTags(ctx, src.registry, selectors...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select tags: %w", err)
+		}
+		images = append(images, selected...)
+	}
+	if job.Catalog != nil {
+		src, err := s.client(job.Source, false)
+		if err != nil {
+			return nil, err
+		}
+		tags, _ := job.Catalog.Tags.selector()
+		mirrored, err := cts.ExpandCatalog(ctx, src.registry, job.Catalog.filter(), tags)
+		if err != nil && (!job.ContinueOnError || ctx.Err() != nil) {
+			return nil, fmt.Errorf("failed to list catalog: %w", err)
+		}
+		if err != nil {
+			listErr = fmt.Errorf("failed to list catalog: %w", err)
+		}
+		images = append(images, mirrored...)
+	}
+
+	if job.ImagesFile == "" {
+		return unique(images), listErr
+	}
+	var r io.Reader = os.Stdin
+	if job.ImagesFile != "-" {
+		f, err := os.Open(job.ImagesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read images: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	listed, err := readImages(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read images: %w", err)
+	}
+	return unique(append(images, listed...)), listErr
+}
+
+// unique drops the images listed before, a tag may be listed and selected.
+func unique(images []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, image := range images {
+		if !seen[image] {
+			seen[image] = true
+			result = append(result, image)
+		}
+	}
+	return result
+}
+
+// readImages reads an image per line, skipping blank lines and comments
+// starting with #.
+func readImages(r io.Reader) ([]string, error) {
+	var images []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		images = append(images, line)
+	}
+	return images, scanner.Err()
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
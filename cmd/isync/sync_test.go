@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/luojun96/isync/throttle"
+)
+
+func TestReloadBandwidth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "isync.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		flag       string
+		config     string
+		wantGlobal int64
+		wantMirror int64
+	}{
+		{"lowered", "", "bandwidth: 5MB\nregistries:\n  mirror:\n    url: http://mirror:5000\n    bandwidth: 512K\n", 5 << 20, 512 << 10},
+		{"removed", "", "registries:\n  mirror:\n    url: http://mirror:5000\n", 0, 0},
+		{"flag kept", "20MB", "bandwidth: 5MB\n", 20 << 20, 0},
+		{"invalid config kept", "", "bandwidth: fast\n", 10 << 20, 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			global := int64(10 << 20)
+			if tt.flag != "" {
+				global = 20 << 20
+			}
+			s := &syncer{
+				global:    &globalOptions{config: path},
+				opts:      &syncOptions{bandwidth: tt.flag},
+				bandwidth: throttle.NewLimiter("global", global),
+				clients: map[string]*client{
+					"destination mirror": {name: "mirror", bandwidth: throttle.NewLimiter("mirror", 1<<20)},
+					"source mirror":      {name: "mirror", bandwidth: throttle.NewLimiter("mirror", 1<<20)},
+				},
+			}
+			write(tt.config)
+			s.reloadBandwidth()
+			if got := s.bandwidth.Limit(); got != tt.wantGlobal {
+				t.Errorf("global bandwidth %d, want %d", got, tt.wantGlobal)
+			}
+			if got := s.clients["destination mirror"].bandwidth.Limit(); got != tt.wantMirror {
+				t.Errorf("mirror bandwidth %d, want %d", got, tt.wantMirror)
+			}
+			if got := s.clients["source mirror"].bandwidth.Limit(); got != 1<<20 {
+				t.Errorf("source bandwidth changed to %d", got)
+			}
+		})
+	}
+}
+
+func TestSelectJobs(t *testing.T) {
+	cfg := &config{Jobs: []jobConfig{
+		{Name: "a", Source: "source", Destination: "mirror", Images: []string{"library/nginx:1.25"}, TagPolicy: "skip"},
+		{Name: "b", Source: "source", Destinations: []string{"mirror", "backup"}, Catalog: &catalogConfig{Prefixes: []string{"library"}}},
+	}}
+	tests := []struct {
+		name    string
+		opts    syncOptions
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{"all jobs", syncOptions{}, nil, []string{"a source [mirror] [library/nginx:1.25] skip", "b source [mirror backup] [] "}, false},
+		{"selected job", syncOptions{jobs: "b"}, nil, []string{"b source [mirror backup] [] "}, false},
+		{"unknown job", syncOptions{jobs: "c"}, nil, nil, true},
+		{"flags override", syncOptions{jobs: "a", dst: "backup", tagPolicy: "fail"}, []string{"library/redis:7"}, []string{"a source [backup] [library/redis:7] fail"}, false},
+		{"flags make a job", syncOptions{src: "source", dst: "mirror"}, []string{"library/redis:7"}, []string{" source [mirror] [library/redis:7] "}, false},
+		{"no destination", syncOptions{src: "source"}, []string{"library/redis:7"}, nil, true},
+		{"invalid mapping", syncOptions{mappings: "library"}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs, err := tt.opts.selectJobs(cfg, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectJobs() error = %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, job := range jobs {
+				got = append(got, fmt.Sprintf("%s %s %v %v %s", job.Name, job.Source, job.destinations(), job.Images, job.TagPolicy))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectJobs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,7 +7,7 @@ import (
 )
 
 type ArtifactSync interface {
-	Sync(ctx context.Context, artifacts []string) error
+	Sync(ctx context.Context, artifacts []string) (*Report, error)
 	Source() registry.Registry
 	Destination() registry.Registry
 }
@@ -0,0 +1,102 @@
+package cts
+
+import (
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// blobLocations records the destination repositories known to hold a blob,
+// so that it can be mounted from them instead of uploaded again, and the
+// blobs being uploaded, so that a blob is never uploaded twice at once.
+type blobLocations struct {
+	mu       sync.Mutex
+	repos    map[digest.Digest][]string
+	inflight map[digest.Digest]chan struct{}
+	// pushed are the blobs uploaded by the sync, as opposed to found
+	pushed map[digest.Digest]bool
+}
+
+func newBlobLocations() *blobLocations {
+	return &blobLocations{
+		repos:    make(map[digest.Digest][]string),
+		inflight: make(map[digest.Digest]chan struct{}),
+		pushed:   make(map[digest.Digest]bool),
+	}
+}
+
+func (l *blobLocations) add(dgst digest.Digest, repo string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.repos[dgst] {
+		if r == repo {
+			return
+		}
+	}
+	l.repos[dgst] = append(l.repos[dgst], repo)
+}
+
+// upload records a blob the sync uploaded into repo.
+func (l *blobLocations) upload(dgst digest.Digest, repo string) {
+	l.add(dgst, repo)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pushed[dgst] = true
+}
+
+func (l *blobLocations) uploaded(dgst digest.Digest) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pushed[dgst]
+}
+
+// known reports whether any repository is known to hold the blob.
+func (l *blobLocations) known(dgst digest.Digest) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.repos[dgst]) > 0
+}
+
+// has reports whether repo is known to hold the blob.
+func (l *blobLocations) has(dgst digest.Digest, repo string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.repos[dgst] {
+		if r == repo {
+			return true
+		}
+	}
+	return false
+}
+
+// source returns a repository other than repo holding the blob.
+func (l *blobLocations) source(dgst digest.Digest, repo string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.repos[dgst] {
+		if r != repo {
+			return r, true
+		}
+	}
+	return "", false
+}
+
+// claim reserves the upload of a blob for the caller, who has to release it
+// when done. When the blob is being uploaded already, claim returns false
+// and a channel that is closed once that upload is done.
+func (l *blobLocations) claim(dgst digest.Digest) (<-chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if done, ok := l.inflight[dgst]; ok {
+		return done, false
+	}
+	l.inflight[dgst] = make(chan struct{})
+	return nil, true
+}
+
+func (l *blobLocations) release(dgst digest.Digest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	close(l.inflight[dgst])
+	delete(l.inflight, dgst)
+}
@@ -0,0 +1,182 @@
+package cts
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSyncBlobLocations(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		// held are the blobs the destination registry holds before the sync,
+		// by repository
+		held map[string][]string
+		want []string
+	}{
+		{
+			name: "own repository",
+			want: []string{
+				"mount team/b from team/a base",
+				"upload team/a a",
+				"upload team/a base",
+				"upload team/b b",
+			},
+		},
+		{
+			name: "held by the destination",
+			held: map[string][]string{"team/a": {"base"}},
+			want: []string{
+				"mount team/b from team/a base",
+				"upload team/a a",
+				"upload team/b b",
+			},
+		},
+		{
+			name: "staging repository",
+			opts: []Option{WithStagingRepository("staging")},
+			want: []string{
+				"mount team/a from staging a",
+				"mount team/a from staging base",
+				"mount team/b from staging b",
+				"mount team/b from staging base",
+				"upload staging a",
+				"upload staging b",
+				"upload staging base",
+			},
+		},
+		{
+			name: "staged already",
+			opts: []Option{WithStagingRepository("staging")},
+			held: map[string][]string{"staging": {"base"}},
+			want: []string{
+				"mount team/a from staging a",
+				"mount team/a from staging base",
+				"mount team/b from staging b",
+				"mount team/b from staging base",
+				"upload staging a",
+				"upload staging b",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := newFakeRegistry(t), newFakeRegistry(t)
+			src.image("team/a", "v1", "base", "a")
+			src.image("team/b", "v1", "base", "b")
+			for repo, blobs := range tt.held {
+				for _, blob := range blobs {
+					dst.addBlob(repo, []byte(blob))
+				}
+			}
+
+			opts := append([]Option{WithConcurrency(1)}, tt.opts...)
+			if _, err := NewImageSync(src.client(), dst.client(), opts...).Sync(context.Background(), []string{"team/a:v1", "team/b:v1"}); err != nil {
+				t.Fatal(err)
+			}
+			events := dst.events()
+			sort.Strings(events)
+			if !reflect.DeepEqual(events, tt.want) {
+				t.Errorf("blob events %q, want %q", events, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncSharedBlob(t *testing.T) {
+	src, dst := newFakeRegistry(t), newFakeRegistry(t)
+	src.image("team/a", "v1", "base", "a")
+	src.image("team/b", "v1", "base", "b")
+	src.image("team/c", "v1", "base")
+	// slow uploads down, so that the images run into the upload of the base
+	// layer of another
+	dst.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		dst.ServeHTTP(w, r)
+	})
+
+	report, err := NewImageSync(src.client(), dst.client()).Sync(context.Background(), []string{"team/a:v1", "team/b:v1", "team/c:v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := report.Count(StatusSynced); n != 3 {
+		t.Errorf("%d images synced, want 3", n)
+	}
+	uploads := 0
+	for _, event := range dst.events() {
+		if strings.HasPrefix(event, "upload ") && strings.HasSuffix(event, " base") {
+			uploads++
+		}
+	}
+	if uploads != 1 {
+		t.Errorf("base layer uploaded %d times, want once: %q", uploads, dst.events())
+	}
+}
+
+func TestSyncManifestWhileOtherLayerUploads(t *testing.T) {
+	src, dst := newFakeRegistry(t), newFakeRegistry(t)
+	src.image("team/big", "v1", "slow layer")
+	src.image("team/small", "v1", "small layer")
+	// hold the uploads of the big image until the small image is pushed
+	small := make(chan struct{})
+	var once sync.Once
+	var held atomic.Bool
+	dst.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v2/team/big/blobs/uploads/") {
+			select {
+			case <-small:
+			case <-time.After(5 * time.Second):
+				held.Store(true)
+			}
+		}
+		dst.ServeHTTP(w, r)
+		if r.Method == http.MethodPut && r.URL.Path == "/v2/team/small/manifests/v1" {
+			once.Do(func() { close(small) })
+		}
+	})
+
+	if _, err := NewImageSync(src.client(), dst.client()).Sync(context.Background(), []string{"team/big:v1", "team/small:v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if held.Load() {
+		t.Error("the manifest of the small image waited for the layer of the big image")
+	}
+}
+
+func TestSyncDeduped(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "own repositories"},
+		{name: "staging repository", opts: []Option{WithStagingRepository("staging")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := newFakeRegistry(t), newFakeRegistry(t)
+			src.image("team/a", "v1", "base layer", "a")
+			src.image("other/b", "v1", "base layer", "b")
+
+			report, err := NewImageSync(src.client(), dst.client(), tt.opts...).Sync(context.Background(), []string{"team/a:v1", "other/b:v1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := int64(len("base layer")); report.Deduped != want {
+				t.Errorf("%d bytes deduped, want %d", report.Deduped, want)
+			}
+			// the layers once each and the configs
+			if dst.pushedBlobs != 5 {
+				t.Errorf("%d blobs pushed, want 5: %q", dst.pushedBlobs, dst.events())
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package cts
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/luojun96/isync/registry"
+)
+
+// RepositoryFilter selects repositories of a catalog. A repository is
+// selected when it lies under one of Prefixes or matches one of Include,
+// unless none is given, and matches none of Exclude.
+type RepositoryFilter struct {
+	// Prefixes are namespaces such as library, which holds library/nginx
+	Prefixes []string
+	// Include and Exclude are regular expressions matching whole repositories
+	Include []string
+	Exclude []string
+}
+
+// Validate reports an invalid pattern of the filter.
+func (f RepositoryFilter) Validate() error {
+	_, err := f.Select(nil)
+	return err
+}
+
+// Select returns the selected repositories, in the order they are given.
+func (f RepositoryFilter) Select(repos []string) ([]string, error) {
+	include, err := compilePatterns("repository", f.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns("repository", f.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []string
+	for _, repo := range repos {
+		included := len(f.Prefixes) == 0 && len(include) == 0
+		for _, prefix := range f.Prefixes {
+			prefix = strings.Trim(prefix, "/")
+			included = included || prefix == "" || repo == prefix || strings.HasPrefix(repo, prefix+"/")
+		}
+		for _, re := range include {
+			included = included || re.MatchString(repo)
+		}
+		for _, re := range exclude {
+			included = included && !re.MatchString(repo)
+		}
+		if included {
+			selected = append(selected, repo)
+		}
+	}
+	return selected, nil
+}
+
+// ExpandCatalog lists the repositories of the registry, and returns the
+// selected tags of the selected ones as artifacts to sync, in the order of
+// the catalog. A repository whose tags cannot be listed does not fail the
+// others, see ExpandTags.
+func ExpandCatalog(ctx context.Context, r registry.Registry, filter RepositoryFilter, tags TagSelector) ([]string, error) {
+	if err := tags.Validate(); err != nil {
+		return nil, err
+	}
+	repos, err := r.Catalog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := filter.Select(repos)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("catalog: %d of %d repositories selected.\n", len(selected), len(repos))
+
+	var selectors []RepositorySelector
+	for _, repo := range selected {
+		selectors = append(selectors, RepositorySelector{Repository: repo, Tags: tags})
+	}
+	return ExpandTags(ctx, r, selectors...)
+}
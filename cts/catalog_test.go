@@ -0,0 +1,87 @@
+package cts
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRepositoryFilter(t *testing.T) {
+	repos := []string{"library/nginx", "library/redis", "library", "libraryx/app", "team/app", "team/app-debug", "team/sub/tool"}
+	tests := []struct {
+		name    string
+		filter  RepositoryFilter
+		want    []string
+		wantErr bool
+	}{
+		{name: "everything", want: repos},
+		{name: "prefix", filter: RepositoryFilter{Prefixes: []string{"library"}}, want: []string{"library/nginx", "library/redis", "library"}},
+		{name: "prefix with slashes", filter: RepositoryFilter{Prefixes: []string{"/team/sub/"}}, want: []string{"team/sub/tool"}},
+		{name: "empty prefix", filter: RepositoryFilter{Prefixes: []string{""}}, want: repos},
+		{name: "include", filter: RepositoryFilter{Include: []string{"team/app.*"}}, want: []string{"team/app", "team/app-debug"}},
+		{name: "include matches whole repositories", filter: RepositoryFilter{Include: []string{"app"}}},
+		{
+			name:   "prefix or include",
+			filter: RepositoryFilter{Prefixes: []string{"library"}, Include: []string{"team/app"}},
+			want:   []string{"library/nginx", "library/redis", "library", "team/app"},
+		},
+		{name: "exclude", filter: RepositoryFilter{Exclude: []string{".*-debug", "library.*"}}, want: []string{"team/app", "team/sub/tool"}},
+		{
+			name:   "exclude wins",
+			filter: RepositoryFilter{Prefixes: []string{"team"}, Exclude: []string{".*-debug"}},
+			want:   []string{"team/app", "team/sub/tool"},
+		},
+		{name: "invalid include", filter: RepositoryFilter{Include: []string{"team/("}}, wantErr: true},
+		{name: "invalid exclude", filter: RepositoryFilter{Exclude: []string{"["}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.filter.Select(repos)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Select() error = %v, want error %v", err, tt.wantErr)
+			}
+			if (tt.filter.Validate() != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", tt.filter.Validate(), tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Select() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandCatalog(t *testing.T) {
+	src := newFakeRegistry(t)
+	src.image("library/nginx", "1.25", "nginx 1.25")
+	src.image("library/nginx", "1.26", "nginx 1.26")
+	src.image("library/redis", "7", "redis 7")
+	src.image("library/private", "1", "private 1")
+	src.image("team/app", "v1", "app v1")
+	// the catalog lists a repository its tags cannot be listed of
+	src.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/library/private/tags/list" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":[{"code":"DENIED","message":"requested access to the resource is denied"}]}`)
+			return
+		}
+		src.ServeHTTP(w, r)
+	})
+
+	artifacts, err := ExpandCatalog(context.Background(), src.client(), RepositoryFilter{Prefixes: []string{"library"}}, TagSelector{Semver: ">=1.26"})
+	if err == nil || !strings.Contains(err.Error(), "library/private") {
+		t.Errorf("ExpandCatalog() error = %v, want the failure of library/private", err)
+	}
+	if strings.Contains(fmt.Sprint(err), "library/nginx") {
+		t.Errorf("ExpandCatalog() error = %v names a repository that was listed", err)
+	}
+	if want := []string{"library/nginx:1.26", "library/redis:7"}; !reflect.DeepEqual(artifacts, want) {
+		t.Errorf("ExpandCatalog() = %v, want %v", artifacts, want)
+	}
+
+	if _, err := ExpandCatalog(context.Background(), src.client(), RepositoryFilter{Include: []string{"("}}, TagSelector{}); err == nil {
+		t.Error("ExpandCatalog with an invalid filter succeeded")
+	}
+}
@@ -1,21 +1,92 @@
 package cts
 
 import (
-	manifestV2 "github.com/distribution/distribution/manifest/schema2"
+	"errors"
+
 	"github.com/docker/distribution"
+	"github.com/luojun96/isync/registry"
+	"github.com/opencontainers/go-digest"
 )
 
 type Image struct {
-	Name     string
-	Tag      string
-	Exists   bool
-	Manifest manifestV2.DeserializedManifest
-	Layers   []Layer
+	Name string
+	Tag  string
+	// Digest pins the manifest of the image, when set together with Tag the
+	// tag has to resolve to it in the source registry.
+	Digest digest.Digest
+	// Destination and DestinationTag are the repository and tag the image is
+	// pushed to, Name and Tag unless a Mapping renames the image.
+	Destination    string
+	DestinationTag string
+	Exists         bool
+	Synced         bool
+	Manifest       registry.Manifest
+	// Children are the manifests of an index, pushed by digest before it.
+	Children []*Image
+	Layers   []*Layer
+	// Planned is an image a dry run would have pushed.
+	Planned bool
+	// Deferred is an image left for the next sync by the cap on the images
+	// a sync pushes.
+	Deferred bool
+	// Err collects the failures of the image across the sync phases.
+	Err error
+}
+
+func (i *Image) fail(err error) {
+	i.Err = errors.Join(i.Err, err)
+}
+
+// ref is the reference the image is pushed with, the tag when there is one,
+// the digest otherwise.
+func (i *Image) ref() string {
+	if i.Tag != "" {
+		return i.Tag
+	}
+	return i.Digest.String()
+}
+
+// destinationRef is the reference the image is pushed with in the destination
+// registry.
+func (i *Image) destinationRef() string {
+	if i.DestinationTag != "" {
+		return i.DestinationTag
+	}
+	return i.Digest.String()
+}
+
+func (i *Image) String() string {
+	s := formatImage(i.Name, i.Tag, i.Digest)
+	if i.Destination != "" && (i.Destination != i.Name || i.DestinationTag != i.Tag) {
+		s += " as " + formatImage(i.Destination, i.DestinationTag, "")
+	}
+	return s
+}
+
+func formatImage(name string, tag string, dgst digest.Digest) string {
+	s := name
+	if tag != "" {
+		s += ":" + tag
+	}
+	if dgst != "" {
+		s += "@" + dgst.String()
+	}
+	return s
 }
 
 type Layer struct {
-	Ref        Image
+	// Ref is the image the layer is synced for, the index for the layers of
+	// its manifests.
+	Ref        *Image
 	Descriptor distribution.Descriptor
 	Exists     bool
 	Synced     bool
+	// Repository is the destination repository the layer was pushed to,
+	// the staging repository when one is configured.
+	Repository string
+	// Deduped is a layer whose blob was pushed for another layer of the sync
+	// and mounted or shared instead of uploaded again.
+	Deduped bool
+	// Transferred is a layer whose blob was downloaded and uploaded by the sync
+	Transferred bool
 }
@@ -2,431 +2,711 @@ package cts
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log"
-	"runtime"
-	"strings"
+	"sync"
 	"time"
 
-	manifestV2 "github.com/distribution/distribution/manifest/schema2"
 	"github.com/luojun96/isync/pool"
+	"github.com/luojun96/isync/progress"
 	"github.com/luojun96/isync/registry"
+	"github.com/luojun96/isync/throttle"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/semaphore"
 )
 
+// Concurrency is the default number of images, and of layer requests, in
+// flight at once.
 const Concurrency int = 3
 
-var concurrency int
-
-type task[T any] struct {
-	t    T
-	s    ArtifactSync
-	exec func(ctx context.Context, t T, s ArtifactSync) error
-	err  error
-}
-
-func (t *task[T]) Execute(ctx context.Context) {
-	t.err = t.exec(ctx, t.t, t.s)
-}
-
 type imageSync struct {
-	sr registry.Registry
-	dr registry.Registry
-}
-
-func NewImageSync(sr registry.Registry, dr registry.Registry) ArtifactSync {
-	return &imageSync{
-		sr: sr,
-		dr: dr,
+	sr          registry.Registry
+	dr          registry.Registry
+	platforms   platformFilter
+	tagPolicy   TagPolicy
+	stagingRepo string
+	mappings    []Mapping
+	blobs       *blobLocations
+	concurrency int
+	// transfers bounds the layer requests of all images together
+	transfers *semaphore.Weighted
+	// retryPolicy bounds how often and how long a layer is pushed again
+	retryPolicy registry.RetryPolicy
+	bandwidth   []*throttle.Limiter
+	progress    *progress.Tracker
+
+	continueOnError bool
+	dryRun          bool
+	// maxRepositories and maxImages cap what a sync pushes, admitted holds
+	// what it pushes
+	maxRepositories int
+	maxImages       int
+	admitted        struct {
+		sync.Mutex
+		repositories map[string]bool
+		images       int
 	}
 }
 
-func (s *imageSync) Sync(ctx context.Context, artifacts []string) error {
-	start := time.Now()
+type Option func(*imageSync)
 
-	concurrency = runtime.GOMAXPROCS(0)
-	log.Printf("concurrency: %d\n", concurrency)
-	images, err := s.getImages(ctx, artifacts)
-	if err != nil {
-		return fmt.Errorf("failed to get images: %v", err)
+// WithPlatforms limits the manifests copied out of manifest lists and image
+// indexes to the given platforms, unless policy is FullIndex, which copies
+// the indexes that list one of the platforms in full.
+func WithPlatforms(policy IndexPolicy, platforms ...Platform) Option {
+	return func(s *imageSync) {
+		s.platforms = platformFilter{platforms: platforms, policy: policy}
 	}
+}
 
-	if err = s.initImages(ctx, images); err != nil {
-		return fmt.Errorf("failed to initialize images: %v", err)
+// WithTagPolicy sets how images whose tag holds different content in the
+// destination registry are handled, they are overwritten by default.
+func WithTagPolicy(policy TagPolicy) Option {
+	return func(s *imageSync) {
+		s.tagPolicy = policy
 	}
+}
 
-	var imagesToPush []*Image
-	for _, image := range images {
-		if !image.Exists {
-			imagesToPush = append(imagesToPush, image)
-		}
+// WithStagingRepository uploads blobs into repo and mounts them from there
+// into the repositories of the images, instead of uploading them into the
+// repositories of the images directly.
+func WithStagingRepository(repo string) Option {
+	return func(s *imageSync) {
+		s.stagingRepo = repo
 	}
+}
 
-	if len(imagesToPush) == 0 {
-		log.Printf("[%vs] All images already exist in destination registry, skipped to push.\n", int(time.Since(start).Seconds()))
-		return nil
+// WithMappings renames images in the destination registry by the first of the
+// mappings that applies to them.
+func WithMappings(mappings ...Mapping) Option {
+	return func(s *imageSync) {
+		s.mappings = append(s.mappings, mappings...)
 	}
-	log.Printf("[%vs] %d of %d images do not exist in destination registry, will be pushed.\n", int(time.Since(start).Seconds()), len(imagesToPush), len(images))
+}
 
-	if err = s.setManifest(ctx, imagesToPush); err != nil {
-		return fmt.Errorf("failed to set manifest: %v", err)
+// WithConcurrency sets how many images, and how many layer uploads and mounts
+// across the images, are in flight at once. The requests of each kind a
+// registry handles at once, the layer checks included, are bounded by its
+// registry.Limits instead.
+func WithConcurrency(n int) Option {
+	return func(s *imageSync) {
+		s.concurrency = n
 	}
+}
 
-	layers := s.getLayers(imagesToPush)
-	if err = s.initLayers(ctx, layers); err != nil {
-		return fmt.Errorf("failed to initialize layers: %v", err)
+// WithRetryPolicy replaces registry.DefaultRetryPolicy for pushing a layer
+// again with a new upload session after a retryable failure.
+func WithRetryPolicy(policy registry.RetryPolicy) Option {
+	return func(s *imageSync) {
+		s.retryPolicy = policy
 	}
+}
 
-	var layersToPush []*Layer
-	for _, layer := range layers {
-		if !layer.Exists {
-			layersToPush = append(layersToPush, layer)
+// WithBandwidth throttles the layer streams to the limits of all limiters,
+// e.g. a global one shared by all syncs and one per destination registry.
+// The limits can be changed while the sync is running.
+func WithBandwidth(limiters ...*throttle.Limiter) Option {
+	return func(s *imageSync) {
+		for _, limiter := range limiters {
+			if limiter != nil {
+				s.bandwidth = append(s.bandwidth, limiter)
+			}
 		}
 	}
+}
 
-	log.Printf("[%vs] %d of %d layers do not exist in destination registry, will be pushed.\n", int(time.Since(start).Seconds()), len(layersToPush), len(layers))
+// WithProgress reports the progress of the layers to tracker.
+func WithProgress(tracker *progress.Tracker) Option {
+	return func(s *imageSync) {
+		s.progress = tracker
+	}
+}
 
-	if err = s.pushLayers(ctx, layersToPush); err != nil {
-		return fmt.Errorf("failed to push layers: %v", err)
+// WithContinueOnError keeps syncing the other images when an image fails,
+// instead of canceling the images in flight and aborting the sync.
+func WithContinueOnError() Option {
+	return func(s *imageSync) {
+		s.continueOnError = true
 	}
+}
 
-	if err = s.mountLayers(ctx, layersToPush); err != nil {
-		return fmt.Errorf("failed to mount layers: %v", err)
+// WithDryRun compares the images with the destination registry without
+// pushing anything, the images that would be pushed are reported as planned.
+func WithDryRun() Option {
+	return func(s *imageSync) {
+		s.dryRun = true
 	}
+}
 
-	if err = s.createManifests(ctx, imagesToPush); err != nil {
-		return fmt.Errorf("failed to create manifests: %v", err)
+// WithMaxRepositories caps the destination repositories a sync pushes images
+// to at n, the images of the other repositories are reported as deferred and
+// left for the next sync. The images that exist in the destination registry
+// already do not count, so that the next sync goes on with the others.
+func WithMaxRepositories(n int) Option {
+	return func(s *imageSync) {
+		s.maxRepositories = n
 	}
+}
 
-	// check if all images are pushed successfully
-	if err = s.checkImages(ctx, imagesToPush); err != nil {
-		return fmt.Errorf("failed to check images: %v", err)
+// WithMaxImages caps the images a sync pushes at n, as WithMaxRepositories
+// caps the repositories.
+func WithMaxImages(n int) Option {
+	return func(s *imageSync) {
+		s.maxImages = n
 	}
+}
 
-	log.Printf("[%vs] All images are pushed to destination registry successfully.\n", int(time.Since(start).Seconds()))
-	return nil
+func NewImageSync(sr registry.Registry, dr registry.Registry, opts ...Option) ArtifactSync {
+	s := &imageSync{
+		sr:          sr,
+		dr:          dr,
+		blobs:       newBlobLocations(),
+		concurrency: Concurrency,
+		retryPolicy: registry.DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.concurrency = max(s.concurrency, 1)
+	s.transfers = semaphore.NewWeighted(int64(s.concurrency))
+	s.admitted.repositories = make(map[string]bool)
+	return s
 }
 
-func (s *imageSync) getImages(ctx context.Context, artifacts []string) ([]*Image, error) {
-	images := []*Image{}
-	for _, image := range artifacts {
-		tokens := strings.Split(image, ":")
-		if len(tokens) != 2 {
-			return nil, fmt.Errorf("Invalidate image type %s", image)
+func (s *imageSync) Sync(ctx context.Context, artifacts []string) (*Report, error) {
+	start := time.Now()
+
+	log.Printf("concurrency: %d\n", s.concurrency)
+	images := s.getImages(artifacts)
+	s.sync(ctx, images)
+
+	report := &Report{Duration: time.Since(start)}
+	for i, image := range images {
+		result := ImageResult{Image: artifacts[i], Status: StatusCanceled, Err: image.Err}
+		if image.Destination != "" {
+			result.Destination = formatImage(image.Destination, image.DestinationTag, "")
+		}
+		switch {
+		case image.Err != nil:
+			result.Status = StatusFailed
+		case image.Exists:
+			result.Status, result.Digest = StatusSkipped, image.Manifest.Digest
+		case image.Deferred:
+			result.Status = StatusDeferred
+		case image.Planned:
+			result.Status, result.Digest = StatusPlanned, image.Manifest.Digest
+		case image.Synced:
+			result.Status, result.Digest = StatusSynced, image.Manifest.Digest
+		}
+		report.Images = append(report.Images, result)
+		for _, layer := range image.Layers {
+			if layer.Deduped {
+				report.Deduped += layer.Descriptor.Size
+			}
 		}
-		images = append(images, &Image{tokens[0], tokens[1], false, manifestV2.DeserializedManifest{}, nil})
 	}
-	return images, nil
+	log.Printf("[%vs] sync finished: %s\n", int(report.Duration.Seconds()), report)
+	return report, report.Err()
 }
 
-func (s *imageSync) initImages(ctx context.Context, images []*Image) error {
-	log.Println("initialize images...")
-	var handler = func(ctx context.Context, image *Image, s ArtifactSync) error {
-		var err error
-		image.Exists, err = s.Destination().ManifestV2Exists(ctx, image.Name, image.Tag)
-		if err != nil {
-			return fmt.Errorf("failed to check manifest exists of %s:%s: %v", image.Name, image.Tag, err)
-		}
+// sync takes every image through its own pipeline, so that an image is
+// pushed as soon as its own layers are, however long the layers of the
+// other images take. Unless continueOnError is set, the first failure
+// cancels the images in flight, which are left unfinished.
+func (s *imageSync) sync(ctx context.Context, images []*Image) {
+	if !s.continueOnError && len(pending(images)) < len(images) {
+		log.Println("invalid images, aborting the sync.")
+		return
+	}
 
-		if image.Tag == "latest" {
-			srcManifest, err := s.Source().ManifestV2(ctx, image.Name, "latest")
-			if err != nil {
-				return fmt.Errorf("failed to get manifest of %s:%s in source registry: %v", image.Name, image.Tag, err)
-			}
-			destManifest, err := s.Destination().ManifestV2(ctx, image.Name, "latest")
-			if err == nil && destManifest.Config.Digest == srcManifest.Config.Digest {
-				image.Exists = true
-			}
-		}
-		if image.Exists {
-			log.Printf("image %s:%s already exists in destination registry, skipped to push.\n", image.Name, image.Tag)
-		} else {
-			log.Printf("Image %s:%s does not exist in destination registry, will be pushed.\n", image.Name, image.Tag)
-		}
-		return nil
+	var opts []pool.Option
+	if !s.continueOnError {
+		opts = append(opts, pool.WithFailFast())
 	}
 
-	p := pool.NewWorkPool(Concurrency)
-	imageTasks := make([]pool.Task, 0)
-	for _, image := range images {
-		t := &task[*Image]{
-			t:    image,
-			s:    s,
-			exec: handler,
+	var handler = func(poolCtx context.Context, image *Image) error {
+		err := s.syncImage(poolCtx, image)
+		// an image canceled by the failure of another is left unfinished
+		if err != nil && (poolCtx.Err() == nil || ctx.Err() != nil) {
+			image.fail(err)
 		}
-		imageTasks = append(imageTasks, t)
-		p.AddTask(t)
+		return err
 	}
-	p.Run(ctx)
 
-	for _, t := range imageTasks {
-		item, ok := t.(*task[*Image])
-		if !ok {
-			return errors.New("failed to convert task to *task[*Image]")
-		}
-		if item.err != nil {
-			return item.err
-		}
+	if err := pool.ForEach(ctx, s.concurrency, pending(images), handler, opts...); err != nil && !s.continueOnError {
+		log.Printf("sync aborted: %v\n", err)
 	}
-	return nil
 }
 
-func (s *imageSync) setManifest(ctx context.Context, images []*Image) error {
-	log.Println("set the manifest of images...")
-	var handler = func(ctx context.Context, image *Image, s ArtifactSync) error {
-		var err error
-		image.Manifest, err = s.Source().ManifestV2(ctx, image.Name, image.Tag)
-		if err != nil {
-			return fmt.Errorf("failed to get manifest of %s:%s: %v", image.Name, image.Tag, err)
-		}
+// syncImage takes an image from comparing its manifest with the destination
+// registry to checking the manifest it pushed.
+func (s *imageSync) syncImage(ctx context.Context, image *Image) error {
+	if err := s.initImage(ctx, image); err != nil {
+		return err
+	}
+	if image.Exists {
+		return nil
+	}
+	if !s.admit(image) {
+		image.Deferred = true
+		log.Printf("image %s is over the caps of the sync, deferred to the next sync.\n", image)
+		return nil
+	}
+	if s.dryRun {
+		image.Planned = true
+		log.Printf("image %s would be pushed, skipped by dry run.\n", image)
 		return nil
 	}
 
-	p := pool.NewWorkPool(Concurrency)
-	imageTasks := make([]pool.Task, 0)
-	for _, image := range images {
-		t := &task[*Image]{
-			t:    image,
-			s:    s,
-			exec: handler,
-		}
-		imageTasks = append(imageTasks, t)
-		p.AddTask(t)
+	layers, err := s.imageLayers(image, image)
+	if err != nil {
+		return err
+	}
+	image.Layers = layers
+	if err := s.syncLayers(ctx, layers); err != nil {
+		return err
 	}
-	p.Run(ctx)
 
-	for _, t := range imageTasks {
-		item, ok := t.(*task[*Image])
-		if !ok {
-			return errors.New("failed to convert task to *task[*Image]")
-		}
-		if item.err != nil {
-			return item.err
-		}
+	log.Printf("create manifest of image %s in destination registry...\n", image)
+	if err := s.putManifest(ctx, image); err != nil {
+		return err
 	}
+	log.Printf("create manifest of image %s in destination registry successfully.\n", image)
 
+	if err := s.checkImage(ctx, image); err != nil {
+		return err
+	}
+	image.Synced = true
 	return nil
 }
 
-func (s *imageSync) getLayers(images []*Image) []*Layer {
-	log.Println("get image layers...")
-	var layers []*Layer
+// admit reports whether an image to push is within the caps of the sync,
+// counting it when it is.
+func (s *imageSync) admit(image *Image) bool {
+	s.admitted.Lock()
+	defer s.admitted.Unlock()
+	newRepository := !s.admitted.repositories[image.Destination]
+	if s.maxRepositories > 0 && newRepository && len(s.admitted.repositories) == s.maxRepositories {
+		return false
+	}
+	if s.maxImages > 0 && s.admitted.images == s.maxImages {
+		return false
+	}
+	s.admitted.repositories[image.Destination] = true
+	s.admitted.images++
+	return true
+}
+
+// pending returns the images that have not failed.
+func pending(images []*Image) []*Image {
+	var result []*Image
 	for _, image := range images {
-		layers = append(layers, &Layer{*image, image.Manifest.Config, false, false})
-		for _, layer := range image.Manifest.Manifest.Layers {
-			layers = append(layers, &Layer{*image, layer, false, false})
+		if image.Err == nil {
+			result = append(result, image)
 		}
 	}
-	return layers
+	return result
 }
 
-func (s *imageSync) initLayers(ctx context.Context, layers []*Layer) error {
-	log.Println("initialize layers...")
-	var handler = func(ctx context.Context, layer *Layer, s ArtifactSync) error {
-		var err error
-		layer.Exists, err = s.Destination().LayerExists(ctx, "trunk", layer.Descriptor.Digest)
-		if err != nil {
-			return fmt.Errorf("failed to check layer exists of %s:%s: %v", layer.Ref.Name, layer.Descriptor.Digest, err)
+// getImages parses the artifacts into images and maps them to their
+// destination, an artifact that cannot be parsed, or is mapped to the tag
+// another image is mapped to, yields an image that failed already.
+func (s *imageSync) getImages(artifacts []string) []*Image {
+	images := []*Image{}
+	targets := make(map[string]*Image)
+	for _, artifact := range artifacts {
+		image, err := parseImage(artifact)
+		if err == nil {
+			err = mapImage(image, s.mappings)
 		}
-		if layer.Exists {
-			log.Printf("layer %s:%s already exists in destination registry, skipped to push.\n", layer.Ref.Name, layer.Descriptor.Digest)
-		} else {
-			log.Printf("layer %s:%s does not exist in destination registry, will be pushed.\n", layer.Ref.Name, layer.Descriptor.Digest)
+		if err != nil {
+			image = &Image{Name: artifact, Err: err}
+		}
+		if image.Err == nil && image.DestinationTag != "" {
+			target := image.Destination + ":" + image.DestinationTag
+			other, ok := targets[target]
+			if ok && (other.Name != image.Name || other.Tag != image.Tag) {
+				image.fail(fmt.Errorf("images %s and %s are both mapped to %s", other.Name+":"+other.Tag, image.Name+":"+image.Tag, target))
+			} else {
+				targets[target] = image
+			}
 		}
-		return nil
+		images = append(images, image)
 	}
+	return images
+}
 
-	p := pool.NewWorkPool(Concurrency)
-	layerTasks := make([]pool.Task, 0)
-	for _, layer := range layers {
-		t := &task[*Layer]{
-			t:    layer,
-			s:    s,
-			exec: handler,
-		}
-		layerTasks = append(layerTasks, t)
-		p.AddTask(t)
+func (s *imageSync) initImage(ctx context.Context, image *Image) error {
+	if err := s.fetchManifest(ctx, image); err != nil {
+		return err
 	}
-	p.Run(ctx)
 
+	dgst, err := s.destinationDigest(ctx, image)
+	if err != nil {
+		return fmt.Errorf("failed to check manifest exists of %s: %w", image, err)
+	}
+	switch {
+	case dgst == "":
+		log.Printf("Image %s does not exist in destination registry, will be pushed.\n", image)
+	case dgst == image.Manifest.Digest:
+		image.Exists = true
+		log.Printf("image %s already exists in destination registry, skipped to push.\n", image)
+	case s.tagPolicy == Skip:
+		image.Exists = true
+		log.Printf("image %s differs in destination registry (%s, source %s), skipped by policy.\n", image, dgst, image.Manifest.Digest)
+	case s.tagPolicy == Fail:
+		return fmt.Errorf("image %s differs in destination registry: digest %s, source digest %s", image, dgst, image.Manifest.Digest)
+	default:
+		log.Printf("image %s differs in destination registry (%s, source %s), will be overwritten.\n", image, dgst, image.Manifest.Digest)
+	}
 	return nil
 }
 
-func (s *imageSync) pushLayers(ctx context.Context, layers []*Layer) error {
-	log.Println("push image layers...")
-	var handler = func(ctx context.Context, layer *Layer, s ArtifactSync) error {
-		if layer.Exists {
-			return nil
-		}
-		log.Printf("push layer %s:%s to destination registry...\n", layer.Ref.Name, layer.Descriptor.Digest)
-		start := time.Now()
-		// push single layer
-		digest, err := s.Source().LayerDownload(ctx, layer.Ref.Name, layer.Descriptor.Digest)
-		if err != nil {
-			return fmt.Errorf("failed to download layer %s:%s: %v", layer.Ref.Name, layer.Descriptor.Digest, err)
-		}
-		if digest != nil {
-			defer digest.Close()
-		}
-		if err = s.Destination().LayerUpload(ctx, "trunk", layer.Descriptor.Digest, digest); err != nil {
-			return fmt.Errorf("failed to upload layer %s:%s: %v", layer.Ref.Name, layer.Descriptor.Digest, err)
-		}
-		layer.Synced = true
-		elapse := int(time.Since(start).Seconds())
-		speed := float64(layer.Descriptor.Size) / 1024 / 1024 / float64(elapse)
-		log.Printf("push layer %s:%s to destination registry successfully, elapse %ds, speed %.2fMB/s.\n", layer.Ref.Name, layer.Descriptor.Digest, elapse, speed)
+// destinationDigest returns the digest of the manifest an image is pushed to,
+// or an empty digest when it does not exist in the destination registry.
+func (s *imageSync) destinationDigest(ctx context.Context, image *Image) (digest.Digest, error) {
+	exists, dgst, err := s.Destination().ManifestV2Exists(ctx, image.Destination, image.destinationRef())
+	if err != nil || !exists || dgst != "" {
+		return dgst, err
+	}
+
+	// the registry did not send Docker-Content-Digest, hash the manifest instead
+	manifest, err := s.Destination().Manifest(ctx, image.Destination, image.destinationRef())
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest, nil
+}
+
+// fetchManifest fetches the manifest of an image from the source registry,
+// along with the manifests of the selected platforms when it is an index, or
+// all of them when the index is copied in full.
+func (s *imageSync) fetchManifest(ctx context.Context, image *Image) error {
+	manifest, err := s.Source().Manifest(ctx, image.Name, image.ref())
+	if err != nil {
+		return fmt.Errorf("failed to get manifest of %s: %w", image, err)
+	}
+	if image.Digest != "" && manifest.Digest != image.Digest {
+		return fmt.Errorf("tag %s of %s resolves to %s in source registry, but is pinned to %s", image.Tag, image.Name, manifest.Digest, image.Digest)
+	}
+	image.Manifest = manifest
+	if !manifest.IsIndex() {
 		return nil
 	}
 
-	p := pool.NewWorkPool(Concurrency)
-	layerTasks := make([]pool.Task, 0)
-	for _, layer := range layers {
-		t := &task[*Layer]{
-			t:    layer,
-			s:    s,
-			exec: handler,
+	descriptors, err := manifest.Manifests()
+	if err != nil {
+		return fmt.Errorf("failed to get manifests of %s: %w", image, err)
+	}
+	selected := 0
+	for _, descriptor := range descriptors {
+		if s.platforms.matches(descriptor) {
+			selected++
+		} else if s.platforms.policy != FullIndex {
+			continue
+		}
+		child := &Image{Name: image.Name, Digest: descriptor.Digest, Destination: image.Destination}
+		if err := s.fetchManifest(ctx, child); err != nil {
+			return err
 		}
-		layerTasks = append(layerTasks, t)
-		p.AddTask(t)
+		image.Children = append(image.Children, child)
 	}
-	p.Run(ctx)
+	if selected == 0 {
+		return fmt.Errorf("no manifest of %s matches platforms %v", image, s.platforms.platforms)
+	}
+	log.Printf("image %s is an index, %d of %d manifests selected, copying %d.\n", image, selected, len(descriptors), len(image.Children))
 
-	for _, t := range layerTasks {
-		item, ok := t.(*task[*Layer])
-		if !ok {
-			return errors.New("failed to convert task to *task[*Layer]")
+	if len(image.Children) < len(descriptors) {
+		if image.Tag == "" {
+			return fmt.Errorf("index %s is pinned by digest and cannot be reduced to platforms %v", image, s.platforms.platforms)
 		}
-		if item.err != nil {
-			return item.err
+		image.Manifest, err = manifest.FilterManifests(s.platforms.matches)
+		if err != nil {
+			return fmt.Errorf("failed to reduce index of %s: %w", image, err)
 		}
-
 	}
 	return nil
 }
 
-func (s *imageSync) mountLayers(ctx context.Context, layers []*Layer) error {
-	log.Println("mount image layers...")
-	var handler = func(ctx context.Context, layer *Layer, s ArtifactSync) error {
-		if !layer.Synced {
-			return fmt.Errorf("layer %s:%s has not been pushed to destination registry", layer.Ref.Name, layer.Descriptor.Digest)
-		}
-		log.Printf("mount layer %s:%s to destination registry...\n", layer.Ref.Name, layer.Descriptor.Digest)
-		if err := s.Destination().LayerMount(ctx, layer.Ref.Name, layer.Descriptor.Digest); err != nil {
-			log.Printf("failed to mount layer %s:%s to destination registry: %v\n", layer.Ref.Name, layer.Descriptor.Digest, err)
-		} else {
-			log.Printf("mount layer %s:%s to destination registry successfully.\n", layer.Ref.Name, layer.Descriptor.Digest)
+func (s *imageSync) imageLayers(ref *Image, image *Image) ([]*Layer, error) {
+	if image.Manifest.IsIndex() {
+		var layers []*Layer
+		for _, child := range image.Children {
+			childLayers, err := s.imageLayers(ref, child)
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, childLayers...)
 		}
-		return nil
+		return layers, nil
+	}
+
+	descriptors, err := image.Manifest.References()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get layers of %s: %w", image, err)
 	}
+	var layers []*Layer
+	for _, descriptor := range descriptors {
+		layers = append(layers, &Layer{Ref: ref, Descriptor: descriptor})
+	}
+	return layers, nil
+}
 
-	p := pool.NewWorkPool(Concurrency)
-	layerTasks := make([]pool.Task, 0)
-	for _, layer := range layers {
-		t := &task[*Layer]{
-			t:    layer,
-			s:    s,
-			exec: handler,
+// putManifest pushes the manifest of an image, pushing the manifests of an
+// index first so that the index never refers to missing manifests.
+func (s *imageSync) putManifest(ctx context.Context, image *Image) error {
+	for _, child := range image.Children {
+		if err := s.putManifest(ctx, child); err != nil {
+			return err
 		}
-		layerTasks = append(layerTasks, t)
-		p.AddTask(t)
 	}
-	p.Run(ctx)
+	if err := s.Destination().ManifestPut(ctx, image.Destination, image.destinationRef(), image.Manifest); err != nil {
+		return fmt.Errorf("failed to put manifest %s: %w", image, err)
+	}
+	return nil
+}
+
+// syncLayers makes sure the layers are in the repository of their image.
+func (s *imageSync) syncLayers(ctx context.Context, layers []*Layer) error {
+	// the layers share the transfer slots, they do not need workers of their own
+	return pool.ForEach(ctx, len(layers), layers, s.syncLayer)
+}
+
+func (s *imageSync) syncLayer(ctx context.Context, layer *Layer) error {
+	s.track(layer, progress.StatusWaiting, nil)
+	err := s.syncBlob(ctx, layer)
+	switch {
+	case err != nil:
+		s.track(layer, progress.StatusFailed, err)
+	case layer.Exists:
+		s.track(layer, progress.StatusExists, nil)
+	case layer.Transferred:
+		s.track(layer, progress.StatusDone, nil)
+	default:
+		s.track(layer, progress.StatusMounted, nil)
+	}
+	return err
+}
 
-	for _, t := range layerTasks {
-		item, ok := t.(*task[*Layer])
-		if !ok {
-			return errors.New("failed to convert task to *task[*Layer]")
+func (s *imageSync) track(layer *Layer, status progress.Status, err error) {
+	if s.progress != nil {
+		s.progress.Update(layer.Ref.String(), layer.Descriptor.Digest, layer.Descriptor.Size, status, err)
+	}
+}
+
+// syncBlob makes sure a layer is in the repository of its image. Blobs are
+// deduplicated by digest across all images: a blob is checked and pushed for
+// one layer at a time, and the other layers of the blob mount it from where
+// it was found or pushed to.
+func (s *imageSync) syncBlob(ctx context.Context, layer *Layer) error {
+	reuse := true
+	for {
+		if reuse && s.blobs.known(layer.Descriptor.Digest) {
+			err := s.transfer(ctx, func() error { return s.reuseLayer(ctx, layer) })
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+			log.Printf("failed to reuse layer %s:%s, will be pushed: %v\n", layer.Ref.Destination, layer.Descriptor.Digest, err)
+			reuse = false
+		}
+		done, ok := s.blobs.claim(layer.Descriptor.Digest)
+		if ok {
+			break
 		}
-		if item.err != nil {
-			return item.err
+		log.Printf("layer %s:%s is being pushed for another image, waiting for it.\n", layer.Ref.Destination, layer.Descriptor.Digest)
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 
-	return nil
+	err := s.pushLayer(ctx, layer)
+	s.blobs.release(layer.Descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	return s.transfer(ctx, func() error { return s.mountLayer(ctx, layer) })
 }
 
-func (s *imageSync) createManifests(ctx context.Context, images []*Image) error {
-	log.Println("create manifests...")
-	var handler = func(ctx context.Context, image *Image, s ArtifactSync) error {
-		log.Printf("create manifest of image %s:%s in destination registry...\n", image.Name, image.Tag)
-		if err := s.Destination().ManifestV2Put(ctx, image.Name, image.Tag, image.Manifest); err != nil {
-			return fmt.Errorf("failed to put manifest %s:%s: %v", image.Name, image.Tag, err)
-		}
-		log.Printf("create manifest of image %s:%s in destination registry successfully.\n", image.Name, image.Tag)
+// transfer runs f in one of the layer slots shared by all images.
+func (s *imageSync) transfer(ctx context.Context, f func() error) error {
+	if err := s.transfers.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer s.transfers.Release(1)
+	return f()
+}
+
+// reuseLayer satisfies a layer with a blob another layer of the sync found
+// in or pushed to the destination registry, mounting it into the repository
+// of the image unless it is there already.
+func (s *imageSync) reuseLayer(ctx context.Context, layer *Layer) error {
+	layer.Repository = layer.Ref.Destination
+	if s.blobs.has(layer.Descriptor.Digest, layer.Ref.Destination) {
+		layer.Deduped = s.blobs.uploaded(layer.Descriptor.Digest)
+		layer.Synced = true
 		return nil
 	}
 
-	p := pool.NewWorkPool(Concurrency)
-	imageTasks := make([]pool.Task, 0)
-	for _, image := range images {
-		t := &task[*Image]{
-			t:    image,
-			s:    s,
-			exec: handler,
-		}
-		imageTasks = append(imageTasks, t)
-		p.AddTask(t)
+	from, _ := s.blobs.source(layer.Descriptor.Digest, layer.Ref.Destination)
+	if err := s.Destination().LayerMount(ctx, layer.Ref.Destination, from, layer.Descriptor.Digest); err != nil {
+		return fmt.Errorf("failed to mount layer %s:%s from %s: %w", layer.Ref.Destination, layer.Descriptor.Digest, from, err)
 	}
-	p.Run(ctx)
+	s.blobs.add(layer.Descriptor.Digest, layer.Ref.Destination)
+	layer.Deduped = true
+	layer.Synced = true
+	log.Printf("mount layer %s:%s from %s in destination registry successfully.\n", layer.Ref.Destination, layer.Descriptor.Digest, from)
+	return nil
+}
 
-	for _, t := range imageTasks {
-		item, ok := t.(*task[*Image])
-		if !ok {
-			return errors.New("failed to convert task to *task[*Image]")
-		}
-		if item.err != nil {
-			return item.err
-		}
+// pushLayer pushes a layer into the staging repository, or into the
+// repository of its image when there is none, unless the destination
+// registry holds it already. Only the upload takes a transfer slot, the
+// checks are bounded by the heads limit of the registry.
+func (s *imageSync) pushLayer(ctx context.Context, layer *Layer) error {
+	if err := s.initLayer(ctx, layer); err != nil || layer.Exists {
+		return err
+	}
+
+	layer.Repository = layer.Ref.Destination
+	if s.stagingRepo != "" {
+		layer.Repository = s.stagingRepo
 	}
+	if s.blobs.has(layer.Descriptor.Digest, layer.Repository) {
+		layer.Synced = true
+		return nil
+	}
+	return s.uploadLayer(ctx, layer)
+}
+
+// uploadLayer uploads a layer into its repository, starting over with a new
+// upload session when a transfer fails on a retryable error, after the delay
+// of the retry policy and as long as its budget allows. The transfer slot is
+// given up while waiting.
+func (s *imageSync) uploadLayer(ctx context.Context, layer *Layer) error {
+	log.Printf("push layer %s:%s to destination registry...\n", layer.Ref.Destination, layer.Descriptor.Digest)
+	start := time.Now()
+	deadline := start.Add(s.retryPolicy.Budget)
+	for attempt := 1; ; attempt++ {
+		err := s.transfer(ctx, func() error { return s.transferLayer(ctx, layer) })
+		if err == nil {
+			break
+		}
+		if attempt >= s.retryPolicy.MaxAttempts || ctx.Err() != nil || !registry.IsRetryable(err) {
+			return err
+		}
+		delay := s.retryPolicy.Delay(attempt, err)
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		log.Printf("push layer %s:%s failed, starting over with a new upload in %v: %v\n", layer.Ref.Destination, layer.Descriptor.Digest, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	s.blobs.upload(layer.Descriptor.Digest, layer.Repository)
+	layer.Synced = true
+	layer.Transferred = true
+	elapse := time.Since(start)
+	// a small layer may take less than the resolution of the clock
+	var speed float64
+	if elapse > 0 {
+		speed = float64(layer.Descriptor.Size) / 1024 / 1024 / elapse.Seconds()
+	}
+	log.Printf("push layer %s:%s to destination registry successfully, elapse %.1fs, speed %.2fMB/s.\n", layer.Ref.Destination, layer.Descriptor.Digest, elapse.Seconds(), speed)
 	return nil
 }
 
-func (s *imageSync) checkImages(ctx context.Context, images []*Image) error {
-	log.Println("check images...")
-	var handler = func(ctx context.Context, image *Image, s ArtifactSync) error {
-		exists, err := s.Destination().ManifestV2Exists(ctx, image.Name, image.Tag)
+func (s *imageSync) initLayer(ctx context.Context, layer *Layer) error {
+	var err error
+	layer.Exists, err = s.Destination().LayerExists(ctx, layer.Ref.Destination, layer.Descriptor.Digest)
+	if err != nil {
+		return fmt.Errorf("failed to check layer exists of %s:%s: %w", layer.Ref.Destination, layer.Descriptor.Digest, err)
+	}
+	if layer.Exists {
+		s.blobs.add(layer.Descriptor.Digest, layer.Ref.Destination)
+	} else if s.stagingRepo != "" {
+		staged, err := s.Destination().LayerExists(ctx, s.stagingRepo, layer.Descriptor.Digest)
 		if err != nil {
-			return fmt.Errorf("failed to check manifest exists of %s:%s: %v", image.Name, image.Tag, err)
+			return fmt.Errorf("failed to check layer exists of %s:%s: %w", s.stagingRepo, layer.Descriptor.Digest, err)
 		}
-
-		if image.Tag == "latest" {
-			destManifest, err := s.Destination().ManifestV2(ctx, image.Name, "latest")
-			if err == nil && destManifest.Config.Digest == image.Manifest.Config.Digest {
-				exists = true
-			}
+		if staged {
+			s.blobs.add(layer.Descriptor.Digest, s.stagingRepo)
 		}
+	}
+	if layer.Exists {
+		log.Printf("layer %s:%s already exists in destination registry, skipped to push.\n", layer.Ref.Destination, layer.Descriptor.Digest)
+	} else {
+		log.Printf("layer %s:%s does not exist in destination registry, will be pushed.\n", layer.Ref.Destination, layer.Descriptor.Digest)
+	}
+	return nil
+}
 
-		if !exists {
-			log.Printf("the manifest of image %s:%s does not exist in destination registry, failed to push.\n", image.Name, image.Tag)
-			return fmt.Errorf("the manifest of image %s:%s does not exist in destination registry", image.Name, image.Tag)
-		}
-		return nil
+// transferLayer streams a layer from the source registry into a new upload
+// session of the destination registry.
+func (s *imageSync) transferLayer(ctx context.Context, layer *Layer) error {
+	reader, err := s.Source().LayerDownload(ctx, layer.Ref.Name, layer.Descriptor.Digest)
+	if err != nil {
+		return fmt.Errorf("failed to download layer %s:%s: %w", layer.Ref.Name, layer.Descriptor.Digest, err)
 	}
+	defer reader.Close()
 
-	p := pool.NewWorkPool(Concurrency)
-	imageTasks := make([]pool.Task, 0)
-	for _, image := range images {
-		t := &task[*Image]{
-			t:    image,
-			s:    s,
-			exec: handler,
+	stream := throttle.Reader(ctx, reader, s.bandwidth...)
+	if s.progress != nil {
+		stream = s.progress.Reader(stream, layer.Ref.String(), layer.Descriptor.Digest, layer.Descriptor.Size)
+	}
+	verifier := newVerifyingReader(stream, layer.Ref.String(), layer.Descriptor)
+	if err = s.Destination().LayerUpload(ctx, layer.Repository, layer.Descriptor.Digest, verifier); err != nil {
+		if verifier.err != nil {
+			return verifier.err
 		}
-		imageTasks = append(imageTasks, t)
-		p.AddTask(t)
+		return fmt.Errorf("failed to upload layer %s:%s: %w", layer.Repository, layer.Descriptor.Digest, err)
+	}
+	if !verifier.verified() {
+		return fmt.Errorf("layer %s:%s was not read completely by the upload", layer.Repository, layer.Descriptor.Digest)
 	}
+	return nil
+}
 
-	p.Run(ctx)
+// mountLayer mounts a layer pushed into the staging repository into the
+// repository of its image.
+func (s *imageSync) mountLayer(ctx context.Context, layer *Layer) error {
+	if layer.Exists {
+		return nil
+	}
+	if !layer.Synced {
+		return fmt.Errorf("layer %s:%s has not been pushed to destination registry", layer.Ref.Destination, layer.Descriptor.Digest)
+	}
+	if layer.Repository == layer.Ref.Destination {
+		return nil
+	}
+	log.Printf("mount layer %s:%s to destination registry...\n", layer.Ref.Destination, layer.Descriptor.Digest)
+	if err := s.Destination().LayerMount(ctx, layer.Ref.Destination, layer.Repository, layer.Descriptor.Digest); err != nil {
+		return fmt.Errorf("failed to mount layer %s:%s from %s: %w", layer.Ref.Destination, layer.Descriptor.Digest, layer.Repository, err)
+	}
+	s.blobs.add(layer.Descriptor.Digest, layer.Ref.Destination)
+	log.Printf("mount layer %s:%s to destination registry successfully.\n", layer.Ref.Destination, layer.Descriptor.Digest)
+	return nil
+}
 
-	for _, t := range imageTasks {
-		item, ok := t.(*task[*Image])
-		if !ok {
-			return errors.New("failed to convert task to *task[*Image]")
-		}
-		if item.err != nil {
-			return fmt.Errorf("failed to check image %s:%s: %v", item.t.Name, item.t.Tag, item.err)
-		}
+func (s *imageSync) checkImage(ctx context.Context, image *Image) error {
+	dgst, err := s.destinationDigest(ctx, image)
+	if err != nil {
+		return fmt.Errorf("failed to check manifest exists of %s: %w", image, err)
 	}
 
+	if dgst == "" {
+		log.Printf("the manifest of image %s does not exist in destination registry, failed to push.\n", image)
+		return fmt.Errorf("the manifest of image %s does not exist in destination registry", image)
+	}
+	if dgst != image.Manifest.Digest {
+		return fmt.Errorf("the manifest of image %s has digest %s in destination registry, expected %s", image, dgst, image.Manifest.Digest)
+	}
 	return nil
 }
 
@@ -0,0 +1,324 @@
+package cts
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luojun96/isync/registry"
+)
+
+func TestSyncIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		copied    int
+		sameIndex bool
+	}{
+		{"all platforms", nil, 3, true},
+		{"reduced", []Option{WithPlatforms(ReduceIndex, Platform{OS: "linux", Architecture: "amd64"}, Platform{OS: "linux", Architecture: "arm64"})}, 2, false},
+		{"full", []Option{WithPlatforms(FullIndex, Platform{OS: "linux", Architecture: "amd64"})}, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := newFakeRegistry(t), newFakeRegistry(t)
+			index := src.index("library/golang", "1.22", "linux/amd64", "linux/arm64", "windows/amd64")
+
+			report, err := NewImageSync(src.client(), dst.client(), tt.opts...).Sync(context.Background(), []string{"library/golang:1.22"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Images[0].Status != StatusSynced {
+				t.Fatalf("status %s, want synced", report.Images[0].Status)
+			}
+			// the index and its manifests
+			if dst.pushedManifests != tt.copied+1 {
+				t.Errorf("%d manifests pushed, want %d", dst.pushedManifests, tt.copied+1)
+			}
+			if got := report.Images[0].Digest == index; got != tt.sameIndex {
+				t.Errorf("index digest %s, source %s", report.Images[0].Digest, index)
+			}
+		})
+	}
+}
+
+func TestSyncIndexWithoutPlatform(t *testing.T) {
+	src, dst := newFakeRegistry(t), newFakeRegistry(t)
+	src.index("library/golang", "1.22", "linux/amd64")
+
+	for _, policy := range []IndexPolicy{ReduceIndex, FullIndex} {
+		s := NewImageSync(src.client(), dst.client(), WithPlatforms(policy, Platform{OS: "linux", Architecture: "s390x"}))
+		report, err := s.Sync(context.Background(), []string{"library/golang:1.22"})
+		if err == nil || report.Images[0].Status != StatusFailed {
+			t.Errorf("%s index without the platform synced: %v", policy, err)
+		}
+	}
+	if dst.pushedManifests != 0 {
+		t.Errorf("%d manifests pushed", dst.pushedManifests)
+	}
+}
+
+func TestParseIndexPolicy(t *testing.T) {
+	for _, policy := range []IndexPolicy{ReduceIndex, FullIndex} {
+		if got, err := ParseIndexPolicy(policy.String()); err != nil || got != policy {
+			t.Errorf("ParseIndexPolicy(%s) = %v, %v", policy, got, err)
+		}
+	}
+	if _, err := ParseIndexPolicy("keep"); err == nil {
+		t.Error("ParseIndexPolicy(keep) succeeded")
+	}
+}
+
+func TestSyncLayerChecksOutsideTransferSlots(t *testing.T) {
+	src, dst := newFakeRegistry(t), newFakeRegistry(t)
+	src.image("library/nginx", "1.25", "layer 1", "layer 2", "layer 3")
+
+	// hold the blob heads of the destination for a while to see them overlap
+	var mu sync.Mutex
+	var inFlight, peak int
+	dst.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/blobs/") {
+			mu.Lock()
+			inFlight++
+			peak = max(peak, inFlight)
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}
+		dst.ServeHTTP(w, r)
+	})
+
+	s := NewImageSync(src.client(), dst.client(), WithConcurrency(1))
+	if _, err := s.Sync(context.Background(), []string{"library/nginx:1.25"}); err != nil {
+		t.Fatal(err)
+	}
+	if peak < 2 {
+		t.Errorf("%d blob heads at once with one transfer slot, want them not to take a slot", peak)
+	}
+}
+
+func TestSyncOCIManifest(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+	}{
+		{"oci content type", "application/vnd.oci.image.manifest.v1+json"},
+		{"generic content type", "application/json"},
+		{"no content type", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := newFakeRegistry(t), newFakeRegistry(t)
+			config := src.addBlob("team/app", []byte(`{"architecture":"amd64","os":"linux"}`))
+			layer := src.addBlob("team/app", []byte("oci layer"))
+			// indented, keys out of order and a trailing newline, as some
+			// tools write them
+			payload := []byte(fmt.Sprintf("{\n\t\"layers\": [{\"mediaType\": \"application/vnd.oci.image.layer.v1.tar+gzip\", \"digest\": \"%s\", \"size\": 9}],\n"+
+				"\t\"config\": {\"mediaType\": \"application/vnd.oci.image.config.v1+json\", \"digest\": \"%s\", \"size\": 37},\n"+
+				"\t\"mediaType\": \"application/vnd.oci.image.manifest.v1+json\",\n\t\"schemaVersion\": 2\n}\n", layer, config))
+			dgst := src.addManifest("team/app", "v1", tt.contentType, payload)
+
+			report, err := NewImageSync(src.client(), dst.client()).Sync(context.Background(), []string{"team/app:v1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Images[0].Digest != dgst {
+				t.Errorf("synced digest %s, want %s", report.Images[0].Digest, dgst)
+			}
+			if got := dst.manifest("team/app", "v1"); !bytes.Equal(got, payload) {
+				t.Errorf("pushed manifest %q, want the source bytes %q", got, payload)
+			}
+			dst.mu.Lock()
+			pushedType := dst.types[dgst]
+			dst.mu.Unlock()
+			if pushedType != "application/vnd.oci.image.manifest.v1+json" {
+				t.Errorf("manifest pushed as %q", pushedType)
+			}
+		})
+	}
+}
+
+func TestSyncLayerRetried(t *testing.T) {
+	policy := registry.RetryPolicy{MaxAttempts: 3, Budget: 10 * time.Second, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	tests := []struct {
+		name string
+		opts []Option
+		// fail is the request of the destination registry answered with
+		// status and Retry-After the first times times
+		fail       func(r *http.Request) bool
+		status     int
+		retryAfter string
+		times      int
+		// wait is how long the sync has to wait at least
+		wait time.Duration
+		err  bool
+	}{
+		{
+			name:       "upload throttled",
+			fail:       initiatesUpload,
+			status:     http.StatusTooManyRequests,
+			retryAfter: "1",
+			times:      1,
+			wait:       time.Second,
+		},
+		{
+			name:   "upload unavailable",
+			fail:   completesUpload,
+			status: http.StatusServiceUnavailable,
+			times:  2,
+		},
+		{
+			name:   "upload unavailable beyond the attempts",
+			fail:   initiatesUpload,
+			status: http.StatusServiceUnavailable,
+			times:  math.MaxInt,
+			err:    true,
+		},
+		{
+			name:       "upload throttled beyond the budget",
+			fail:       initiatesUpload,
+			status:     http.StatusTooManyRequests,
+			retryAfter: "60",
+			times:      1,
+			err:        true,
+		},
+		{
+			name:       "mount throttled",
+			opts:       []Option{WithStagingRepository("staging")},
+			fail:       func(r *http.Request) bool { return r.URL.Query().Get("mount") != "" },
+			status:     http.StatusTooManyRequests,
+			retryAfter: "0",
+			times:      1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := newFakeRegistry(t), newFakeRegistry(t)
+			src.image("library/nginx", "1.25", "layer")
+
+			var mu sync.Mutex
+			failed := 0
+			dst.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				fail := tt.fail(r) && failed < tt.times
+				if fail {
+					failed++
+				}
+				mu.Unlock()
+				if !fail {
+					dst.ServeHTTP(w, r)
+					return
+				}
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+			})
+
+			opts := append([]Option{WithRetryPolicy(policy)}, tt.opts...)
+			start := time.Now()
+			_, err := NewImageSync(src.client(), dst.client(), opts...).Sync(context.Background(), []string{"library/nginx:1.25"})
+			if elapsed := time.Since(start); elapsed < tt.wait || elapsed > tt.wait+5*time.Second {
+				t.Errorf("sync took %v, want about %v", elapsed, tt.wait)
+			}
+			if tt.err {
+				if err == nil {
+					t.Fatal("sync succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failed != tt.times {
+				t.Errorf("%d requests failed, want %d", failed, tt.times)
+			}
+			if dst.manifest("library/nginx", "1.25") == nil {
+				t.Error("manifest not pushed")
+			}
+		})
+	}
+}
+
+// initiatesUpload reports whether r opens an upload session.
+func initiatesUpload(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Query().Get("mount") == ""
+}
+
+// completesUpload reports whether r closes an upload session with its last
+// chunk.
+func completesUpload(r *http.Request) bool {
+	return r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/")
+}
+
+func TestSyncDryRunAndCaps(t *testing.T) {
+	artifacts := []string{"team/a:v1", "team/a:v2", "team/held:v1", "team/b:v1", "team/c:v1"}
+	tests := []struct {
+		name string
+		opts []Option
+		want []Status
+	}{
+		{
+			name: "dry run",
+			opts: []Option{WithDryRun()},
+			want: []Status{StatusPlanned, StatusPlanned, StatusSkipped, StatusPlanned, StatusPlanned},
+		},
+		{
+			name: "max images",
+			opts: []Option{WithMaxImages(2)},
+			want: []Status{StatusSynced, StatusSynced, StatusSkipped, StatusDeferred, StatusDeferred},
+		},
+		{
+			name: "max repositories",
+			opts: []Option{WithMaxRepositories(2)},
+			want: []Status{StatusSynced, StatusSynced, StatusSkipped, StatusSynced, StatusDeferred},
+		},
+		{
+			name: "max images and repositories",
+			opts: []Option{WithMaxImages(3), WithMaxRepositories(1)},
+			want: []Status{StatusSynced, StatusSynced, StatusSkipped, StatusDeferred, StatusDeferred},
+		},
+		{
+			name: "dry run within caps",
+			opts: []Option{WithDryRun(), WithMaxImages(1)},
+			want: []Status{StatusPlanned, StatusDeferred, StatusSkipped, StatusDeferred, StatusDeferred},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := newFakeRegistry(t), newFakeRegistry(t)
+			for _, artifact := range artifacts {
+				repo, tag, _ := strings.Cut(artifact, ":")
+				src.image(repo, tag, artifact)
+			}
+			// the images held by the destination do not count against the caps
+			dst.image("team/held", "v1", "team/held:v1")
+
+			opts := append([]Option{WithConcurrency(1)}, tt.opts...)
+			report, err := NewImageSync(src.client(), dst.client(), opts...).Sync(context.Background(), artifacts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, result := range report.Images {
+				if result.Status != tt.want[i] {
+					t.Errorf("image %s is %s, want %s", result.Image, result.Status, tt.want[i])
+				}
+				repo, tag, _ := strings.Cut(result.Image, ":")
+				if pushed := dst.manifest(repo, tag) != nil && repo != "team/held"; pushed != (result.Status == StatusSynced) {
+					t.Errorf("image %s is %s, pushed: %v", result.Image, result.Status, pushed)
+				}
+			}
+			if report.Count(StatusSynced) == 0 && dst.pushedBlobs > 0 {
+				t.Errorf("%d blobs pushed without syncing an image", dst.pushedBlobs)
+			}
+		})
+	}
+}
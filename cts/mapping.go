@@ -0,0 +1,144 @@
+package cts
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// Mapping renames images on their way to the destination registry. Map
+// returns the destination repository and tag of a source repository and tag,
+// or false when the mapping does not apply to the image. The tag is empty for
+// images given by digest only.
+type Mapping interface {
+	Map(repo string, tag string) (string, string, bool)
+}
+
+// PrefixMapping replaces the leading path components From of a repository
+// with To, e.g. library to mirror/dockerhub maps library/nginx to
+// mirror/dockerhub/nginx. An empty From prefixes every repository with To.
+type PrefixMapping struct {
+	From string
+	To   string
+}
+
+func (m PrefixMapping) Map(repo string, tag string) (string, string, bool) {
+	from, to := strings.Trim(m.From, "/"), strings.Trim(m.To, "/")
+	var rest string
+	switch {
+	case from == "":
+		rest = repo
+	case repo == from:
+	case strings.HasPrefix(repo, from+"/"):
+		rest = strings.TrimPrefix(repo, from+"/")
+	default:
+		return "", "", false
+	}
+	switch {
+	case to == "":
+		return rest, tag, rest != ""
+	case rest == "":
+		return to, tag, true
+	}
+	return to + "/" + rest, tag, true
+}
+
+// RegexMapping matches the whole repo:tag of an image, or the repository of an
+// image given by digest only, and expands the replacement with the capture
+// groups of the match, e.g. ^bitnami/(.+):(.+)$ to mirror/$1:v$2. A
+// replacement without a tag keeps the tag of the image.
+type RegexMapping struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// NewRegexMapping compiles pattern, which is anchored at both ends.
+func NewRegexMapping(pattern string, replacement string) (*RegexMapping, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid mapping pattern %q: %w", pattern, err)
+	}
+	return &RegexMapping{pattern: re, replacement: replacement}, nil
+}
+
+func (m *RegexMapping) Map(repo string, tag string) (string, string, bool) {
+	subject := repo
+	if tag != "" {
+		subject = repo + ":" + tag
+	}
+	match := m.pattern.FindStringSubmatchIndex(subject)
+	if match == nil {
+		return "", "", false
+	}
+	mapped := string(m.pattern.ExpandString(nil, m.replacement, subject, match))
+	mappedRepo, mappedTag := splitTag(mapped)
+	if mappedTag == "" {
+		mappedTag = tag
+	}
+	return mappedRepo, mappedTag, true
+}
+
+// TableMapping maps images listed as repo:tag, or whole repositories, to
+// repo:tag or repositories. Entries of an image take precedence over entries
+// of its repository, a repository mapped to a repository keeps its tags.
+type TableMapping map[string]string
+
+func (m TableMapping) Map(repo string, tag string) (string, string, bool) {
+	mapped, ok := m[repo+":"+tag]
+	if !ok || tag == "" {
+		if mapped, ok = m[repo]; !ok {
+			return "", "", false
+		}
+	}
+	mappedRepo, mappedTag := splitTag(mapped)
+	if mappedTag == "" {
+		mappedTag = tag
+	}
+	return mappedRepo, mappedTag, true
+}
+
+// splitTag splits repo:tag, the colon of a registry port is not a tag
+// separator.
+func splitTag(s string) (string, string) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 || strings.Contains(s[i+1:], "/") {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// mapImage sets where an image is pushed to by the first mapping that applies,
+// images no mapping applies to keep their repository and tag.
+func mapImage(image *Image, mappings []Mapping) error {
+	image.Destination, image.DestinationTag = image.Name, image.Tag
+	for _, m := range mappings {
+		repo, tag, ok := m.Map(image.Name, image.Tag)
+		if !ok {
+			continue
+		}
+		if !validRepository(repo) {
+			return fmt.Errorf("image %s is mapped to invalid repository %q", image, repo)
+		}
+		if tag != "" && !tagPattern.MatchString(tag) {
+			return fmt.Errorf("image %s is mapped to invalid tag %q", image, tag)
+		}
+		image.Destination, image.DestinationTag = repo, tag
+		return nil
+	}
+	return nil
+}
+
+var tagPattern = regexp.MustCompile(`^` + reference.TagRegexp.String() + `$`)
+
+// validRepository reports whether repo is a repository path without a
+// registry host.
+func validRepository(repo string) bool {
+	ref, err := reference.Parse(repo)
+	if err != nil {
+		return false
+	}
+	named, ok := ref.(reference.Named)
+	return ok && named.Name() == repo && repositoryPath(repo) == repo
+}
@@ -0,0 +1,91 @@
+package cts
+
+import (
+	"testing"
+)
+
+func TestMappings(t *testing.T) {
+	regex := func(pattern string, replacement string) Mapping {
+		m, err := NewRegexMapping(pattern, replacement)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	table := TableMapping{
+		"library/redis:7": "mirror/redis:stable",
+		"library/redis":   "mirror/redis",
+		"library/nginx:1": "mirror/nginx",
+	}
+	tests := []struct {
+		name     string
+		mapping  Mapping
+		repo     string
+		tag      string
+		wantRepo string
+		wantTag  string
+		wantOK   bool
+	}{
+		{"prefix", PrefixMapping{From: "library", To: "mirror/dockerhub"}, "library/nginx", "1.25", "mirror/dockerhub/nginx", "1.25", true},
+		{"prefix whole repository", PrefixMapping{From: "library/nginx", To: "mirror/nginx"}, "library/nginx", "1.25", "mirror/nginx", "1.25", true},
+		{"prefix of components only", PrefixMapping{From: "lib", To: "mirror"}, "library/nginx", "1.25", "", "", false},
+		{"prefix not applying", PrefixMapping{From: "library", To: "mirror"}, "bitnami/redis", "7", "", "", false},
+		{"empty from", PrefixMapping{To: "mirror/"}, "library/nginx", "1.25", "mirror/library/nginx", "1.25", true},
+		{"empty to", PrefixMapping{From: "/library/", To: ""}, "library/nginx", "", "nginx", "", true},
+		{"empty to of whole repository", PrefixMapping{From: "library/nginx"}, "library/nginx", "1.25", "", "", false},
+		{"regex", regex(`bitnami/(.+):(.+)`, "mirror/bitnami/$1:v$2"), "bitnami/redis", "7.2", "mirror/bitnami/redis", "v7.2", true},
+		{"regex named groups", regex(`(?P<ns>[^/]+)/(?P<name>.+)`, "mirror/${ns}-${name}"), "bitnami/redis", "7", "mirror/bitnami-redis", "7", true},
+		{"regex keeps tag", regex(`library/(.+):1\..*`, "mirror/$1"), "library/nginx", "1.25", "mirror/nginx", "1.25", true},
+		{"regex anchored", regex(`nginx`, "mirror/nginx"), "library/nginx", "1.25", "", "", false},
+		{"regex of digest", regex(`library/(.+)`, "mirror/$1"), "library/nginx", "", "mirror/nginx", "", true},
+		{"table image", table, "library/redis", "7", "mirror/redis", "stable", true},
+		{"table repository", table, "library/redis", "6", "mirror/redis", "6", true},
+		{"table image to repository", table, "library/nginx", "1", "mirror/nginx", "1", true},
+		{"table of digest", table, "library/redis", "", "mirror/redis", "", true},
+		{"table not listed", table, "library/nginx", "1.25", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, tag, ok := tt.mapping.Map(tt.repo, tt.tag)
+			if ok != tt.wantOK || ok && (repo != tt.wantRepo || tag != tt.wantTag) {
+				t.Errorf("Map(%s, %s) = %s, %s, %v, want %s, %s, %v", tt.repo, tt.tag, repo, tag, ok, tt.wantRepo, tt.wantTag, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNewRegexMappingInvalid(t *testing.T) {
+	if _, err := NewRegexMapping(`library/(.+`, "mirror/$1"); err == nil {
+		t.Error("NewRegexMapping accepted an invalid pattern")
+	}
+}
+
+func TestMapImage(t *testing.T) {
+	mappings := []Mapping{
+		TableMapping{"library/redis:7": "Mirror/redis:stable", "library/busybox": "mirror/busybox:bad tag"},
+		PrefixMapping{From: "library", To: "mirror"},
+		PrefixMapping{From: "library", To: "other"},
+	}
+	tests := []struct {
+		name    string
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{"library/nginx", "1.25", "mirror/nginx:1.25", false},
+		{"bitnami/redis", "7", "bitnami/redis:7", false},
+		{"library/redis", "7", "", true},
+		{"library/busybox", "1", "", true},
+	}
+	for _, tt := range tests {
+		image := &Image{Name: tt.name, Tag: tt.tag}
+		err := mapImage(image, mappings)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("mapImage(%s:%s) error = %v, want error %v", tt.name, tt.tag, err, tt.wantErr)
+			continue
+		}
+		if got := image.Destination + ":" + image.DestinationTag; err == nil && got != tt.want {
+			t.Errorf("mapImage(%s:%s) = %s, want %s", tt.name, tt.tag, got, tt.want)
+		}
+	}
+}
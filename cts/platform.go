@@ -0,0 +1,90 @@
+package cts
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/distribution/distribution/manifest/manifestlist"
+)
+
+type IndexPolicy int
+
+const (
+	// ReduceIndex pushes a rewritten index that lists only the manifests of
+	// the selected platforms, so the index gets a new digest.
+	ReduceIndex IndexPolicy = iota
+	// FullIndex copies indexes unchanged with every manifest they list,
+	// preserving their digest, as long as they list one of the selected
+	// platforms.
+	FullIndex
+)
+
+func ParseIndexPolicy(s string) (IndexPolicy, error) {
+	switch s {
+	case "reduce":
+		return ReduceIndex, nil
+	case "full":
+		return FullIndex, nil
+	}
+	return ReduceIndex, fmt.Errorf("invalid index policy %q, expected reduce or full", s)
+}
+
+func (p IndexPolicy) String() string {
+	if p == FullIndex {
+		return "full"
+	}
+	return "reduce"
+}
+
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// ParsePlatform parses a platform in the os/arch[/variant] form, e.g.
+// linux/arm64/v8.
+func ParsePlatform(s string) (Platform, error) {
+	tokens := strings.Split(s, "/")
+	if len(tokens) < 2 || len(tokens) > 3 || tokens[0] == "" || tokens[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+	}
+	p := Platform{OS: tokens[0], Architecture: tokens[1]}
+	if len(tokens) == 3 {
+		p.Variant = tokens[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+func (p Platform) matches(spec manifestlist.PlatformSpec) bool {
+	if p.OS != spec.OS || p.Architecture != spec.Architecture {
+		return false
+	}
+	return p.Variant == "" || p.Variant == spec.Variant
+}
+
+type platformFilter struct {
+	platforms []Platform
+	policy    IndexPolicy
+}
+
+// matches reports whether a manifest of an index is selected, every manifest
+// is selected when no platform is configured.
+func (f platformFilter) matches(descriptor manifestlist.ManifestDescriptor) bool {
+	if len(f.platforms) == 0 {
+		return true
+	}
+	for _, p := range f.platforms {
+		if p.matches(descriptor.Platform) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package cts
+
+import "fmt"
+
+// TagPolicy decides what happens to an image whose tag already exists in the
+// destination registry with a different manifest digest.
+type TagPolicy int
+
+const (
+	Overwrite TagPolicy = iota
+	Skip
+	Fail
+)
+
+func ParseTagPolicy(s string) (TagPolicy, error) {
+	switch s {
+	case "overwrite":
+		return Overwrite, nil
+	case "skip":
+		return Skip, nil
+	case "fail":
+		return Fail, nil
+	}
+	return Overwrite, fmt.Errorf("invalid tag policy %q, expected overwrite, skip or fail", s)
+}
+
+func (p TagPolicy) String() string {
+	switch p {
+	case Skip:
+		return "skip"
+	case Fail:
+		return "fail"
+	}
+	return "overwrite"
+}
@@ -0,0 +1,88 @@
+package cts
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSyncTagPolicy(t *testing.T) {
+	tests := []struct {
+		policy     TagPolicy
+		omitDigest bool
+		status     Status
+		overwrite  bool
+	}{
+		{Overwrite, false, StatusSynced, true},
+		{Skip, false, StatusSkipped, false},
+		{Fail, false, StatusFailed, false},
+		{Overwrite, true, StatusSynced, true},
+		{Skip, true, StatusSkipped, false},
+		{Fail, true, StatusFailed, false},
+	}
+	for _, tt := range tests {
+		name := tt.policy.String()
+		if tt.omitDigest {
+			name += " without digest header"
+		}
+		t.Run(name, func(t *testing.T) {
+			src, dst := newFakeRegistry(t), newFakeRegistry(t)
+			src.image("team/app", "1.0", "new layer")
+			// the same tag holds another manifest in the destination
+			dst.image("team/app", "1.0", "old layer")
+			old := dst.manifest("team/app", "1.0")
+			dst.omitDigest = tt.omitDigest
+
+			report, err := NewImageSync(src.client(), dst.client(), WithTagPolicy(tt.policy)).Sync(context.Background(), []string{"team/app:1.0"})
+			if got := report.Images[0].Status; got != tt.status {
+				t.Fatalf("status %s, want %s: %v", got, tt.status, err)
+			}
+			if tt.status == StatusFailed && (err == nil || !strings.Contains(err.Error(), "differs in destination registry")) {
+				t.Errorf("error %v, want the digests that differ", err)
+			}
+			if tt.status != StatusFailed && err != nil {
+				t.Errorf("error %v", err)
+			}
+			pushed := dst.manifest("team/app", "1.0")
+			if overwritten := !bytes.Equal(pushed, old); overwritten != tt.overwrite {
+				t.Errorf("tag overwritten %v, want %v", overwritten, tt.overwrite)
+			}
+			if tt.overwrite && !bytes.Equal(pushed, src.manifest("team/app", "1.0")) {
+				t.Errorf("tag holds %s, want the source manifest", pushed)
+			}
+			// without the header the digest is taken from the manifest
+			if gets := dst.manifestGets > 0; gets != tt.omitDigest {
+				t.Errorf("%d manifests fetched from the destination", dst.manifestGets)
+			}
+		})
+	}
+}
+
+func TestSyncSameManifest(t *testing.T) {
+	for _, omitDigest := range []bool{false, true} {
+		src, dst := newFakeRegistry(t), newFakeRegistry(t)
+		src.image("team/app", "1.0", "layer")
+		dst.image("team/app", "1.0", "layer")
+		dst.omitDigest = omitDigest
+
+		report, err := NewImageSync(src.client(), dst.client(), WithTagPolicy(Fail)).Sync(context.Background(), []string{"team/app:1.0"})
+		if err != nil || report.Images[0].Status != StatusSkipped {
+			t.Errorf("omitDigest %v: status %s, %v, want skipped", omitDigest, report.Images[0].Status, err)
+		}
+		if dst.pushedManifests != 0 || dst.pushedBlobs != 0 {
+			t.Errorf("omitDigest %v: %d manifests and %d blobs pushed", omitDigest, dst.pushedManifests, dst.pushedBlobs)
+		}
+	}
+}
+
+func TestParseTagPolicy(t *testing.T) {
+	for _, policy := range []TagPolicy{Overwrite, Skip, Fail} {
+		if got, err := ParseTagPolicy(policy.String()); err != nil || got != policy {
+			t.Errorf("ParseTagPolicy(%s) = %v, %v", policy, got, err)
+		}
+	}
+	if _, err := ParseTagPolicy("replace"); err == nil {
+		t.Error("ParseTagPolicy(replace) succeeded")
+	}
+}
@@ -0,0 +1,46 @@
+package cts
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// parseImage parses an artifact in the name[:tag][@digest] form. A registry
+// host in front of the name, e.g. host:5000/repo:tag, is dropped since
+// images are always read from the source registry. An artifact without
+// tag and digest is rejected rather than defaulting to latest.
+func parseImage(artifact string) (*Image, error) {
+	ref, err := reference.Parse(artifact)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %q: %v", artifact, err)
+	}
+	named, ok := ref.(reference.Named)
+	if !ok {
+		return nil, fmt.Errorf("invalid image reference %q: missing repository name", artifact)
+	}
+
+	image := &Image{Name: repositoryPath(named.Name())}
+	if tagged, ok := ref.(reference.Tagged); ok {
+		image.Tag = tagged.Tag()
+	}
+	if digested, ok := ref.(reference.Digested); ok {
+		image.Digest = digested.Digest()
+	}
+	if image.Tag == "" && image.Digest == "" {
+		return nil, fmt.Errorf("invalid image reference %q: missing tag or digest", artifact)
+	}
+	return image, nil
+}
+
+// repositoryPath strips the registry host from a name the way docker does:
+// the first component is a host when it contains a "." or ":", an upper case
+// letter, or is localhost.
+func repositoryPath(name string) string {
+	first, rest, ok := strings.Cut(name, "/")
+	if ok && (strings.ContainsAny(first, ".:") || strings.ToLower(first) != first || first == "localhost") {
+		return rest
+	}
+	return name
+}
@@ -0,0 +1,47 @@
+package cts
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParseImage(t *testing.T) {
+	const dgst = digest.Digest("sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4")
+	tests := []struct {
+		artifact string
+		want     Image
+		err      bool
+	}{
+		{artifact: "nginx:1.25", want: Image{Name: "nginx", Tag: "1.25"}},
+		{artifact: "library/nginx:1.25", want: Image{Name: "library/nginx", Tag: "1.25"}},
+		{artifact: "library/nginx@" + dgst.String(), want: Image{Name: "library/nginx", Digest: dgst}},
+		{artifact: "library/nginx:1.25@" + dgst.String(), want: Image{Name: "library/nginx", Tag: "1.25", Digest: dgst}},
+		{artifact: "registry.example.com/library/nginx:1.25", want: Image{Name: "library/nginx", Tag: "1.25"}},
+		{artifact: "localhost:5000/team/app:v1", want: Image{Name: "team/app", Tag: "v1"}},
+		{artifact: "localhost/app:v1", want: Image{Name: "app", Tag: "v1"}},
+		{artifact: "team/app.web:v1", want: Image{Name: "team/app.web", Tag: "v1"}},
+		{artifact: "Registry/library/nginx:1.25", want: Image{Name: "library/nginx", Tag: "1.25"}},
+		{artifact: "library/nginx", err: true},
+		{artifact: "library/Nginx:1.25", err: true},
+		{artifact: "library/nginx:", err: true},
+		{artifact: "library/nginx@sha256:abc", err: true},
+		{artifact: "", err: true},
+	}
+	for _, tt := range tests {
+		image, err := parseImage(tt.artifact)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseImage(%q) = %+v, want an error", tt.artifact, image)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseImage(%q): %v", tt.artifact, err)
+			continue
+		}
+		if image.Name != tt.want.Name || image.Tag != tt.want.Tag || image.Digest != tt.want.Digest {
+			t.Errorf("parseImage(%q) = %s, %s, %s, want %s, %s, %s", tt.artifact, image.Name, image.Tag, image.Digest, tt.want.Name, tt.want.Tag, tt.want.Digest)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package cts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/luojun96/isync/registry"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	mediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+)
+
+// fakeRegistry is an in-memory registry that, like registry:2, rejects
+// manifests referring to blobs or manifests it does not hold.
+type fakeRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string]map[digest.Digest][]byte
+	manifests map[string]map[string][]byte
+	types     map[digest.Digest]string
+	uploads   map[string][]byte
+	sessions  int
+	// pushed counts the manifests and blobs pushed
+	pushedManifests int
+	pushedBlobs     int
+	// manifestGets counts the manifests served with their payload
+	manifestGets int
+	// omitDigest leaves out Docker-Content-Digest, as some registries do
+	omitDigest bool
+	// blobEvents records the uploads and mounts of blobs in their order, as
+	// "upload <repo> <blob>" and "mount <repo> from <repo> <blob>", with the
+	// blobs named by their content
+	blobEvents []string
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	f := &fakeRegistry{
+		blobs:     make(map[string]map[digest.Digest][]byte),
+		manifests: make(map[string]map[string][]byte),
+		types:     make(map[digest.Digest]string),
+		uploads:   make(map[string][]byte),
+	}
+	f.Server = httptest.NewServer(f)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeRegistry) client() registry.Registry {
+	return registry.NewRegistry(f.URL, registry.WithCredential("test", "test"))
+}
+
+func (f *fakeRegistry) addBlob(repo string, data []byte) digest.Digest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dgst := digest.FromBytes(data)
+	if f.blobs[repo] == nil {
+		f.blobs[repo] = make(map[digest.Digest][]byte)
+	}
+	f.blobs[repo][dgst] = data
+	return dgst
+}
+
+func (f *fakeRegistry) addManifest(repo string, tag string, mediaType string, payload []byte) digest.Digest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dgst := digest.FromBytes(payload)
+	if f.manifests[repo] == nil {
+		f.manifests[repo] = make(map[string][]byte)
+	}
+	f.manifests[repo][dgst.String()] = payload
+	if tag != "" {
+		f.manifests[repo][tag] = payload
+	}
+	f.types[dgst] = mediaType
+	return dgst
+}
+
+// image adds an image of the given layer contents and returns its digest.
+func (f *fakeRegistry) image(repo string, tag string, layers ...string) digest.Digest {
+	config := fmt.Sprintf(`{"image":%q}`, repo+":"+tag)
+	configDigest := f.addBlob(repo, []byte(config))
+	var descriptors []string
+	for _, layer := range layers {
+		dgst := f.addBlob(repo, []byte(layer))
+		descriptors = append(descriptors, fmt.Sprintf(`{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","size":%d,"digest":"%s"}`, len(layer), dgst))
+	}
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":%d,"digest":"%s"},"layers":[%s]}`,
+		mediaTypeManifest, len(config), configDigest, strings.Join(descriptors, ","))
+	return f.addManifest(repo, tag, mediaTypeManifest, []byte(manifest))
+}
+
+// index adds an index of an image per platform, e.g. linux/amd64, and returns
+// its digest.
+func (f *fakeRegistry) index(repo string, tag string, platforms ...string) digest.Digest {
+	var descriptors []string
+	for _, platform := range platforms {
+		dgst := f.image(repo, "", "layer of "+platform)
+		size := len(f.manifest(repo, dgst.String()))
+		os, arch, _ := strings.Cut(platform, "/")
+		descriptors = append(descriptors, fmt.Sprintf(`{"mediaType":"%s","size":%d,"digest":"%s","platform":{"os":"%s","architecture":"%s"}}`,
+			mediaTypeManifest, size, dgst, os, arch))
+	}
+	index := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%s","manifests":[%s]}`, mediaTypeIndex, strings.Join(descriptors, ","))
+	return f.addManifest(repo, tag, mediaTypeIndex, []byte(index))
+}
+
+// events returns the blob events, leaving out those of the configs of the
+// images.
+func (f *fakeRegistry) events() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var events []string
+	for _, event := range f.blobEvents {
+		if !strings.Contains(event, `{"image"`) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// manifest returns the manifest of repo:ref, nil when there is none.
+func (f *fakeRegistry) manifest(repo string, ref string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.manifests[repo][ref]
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case r.URL.Path == "/v2/":
+	case path == "_catalog":
+		var repos []string
+		for repo := range f.manifests {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+		json.NewEncoder(w).Encode(map[string]any{"repositories": repos})
+	case strings.HasSuffix(path, "/tags/list"):
+		repo := strings.TrimSuffix(path, "/tags/list")
+		if f.manifests[repo] == nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"NAME_UNKNOWN","message":"repository name not known to registry"}]}`)
+			return
+		}
+		tags := []string{}
+		for ref := range f.manifests[repo] {
+			if !strings.Contains(ref, ":") {
+				tags = append(tags, ref)
+			}
+		}
+		sort.Strings(tags)
+		json.NewEncoder(w).Encode(map[string]any{"name": repo, "tags": tags})
+	case strings.Contains(path, "/manifests/"):
+		repo, ref, _ := strings.Cut(path, "/manifests/")
+		f.serveManifest(w, r, repo, ref)
+	case strings.Contains(path, "/blobs/uploads/"):
+		repo, id, _ := strings.Cut(path, "/blobs/uploads/")
+		f.serveUpload(w, r, repo, id)
+	case strings.Contains(path, "/blobs/"):
+		repo, dgst, _ := strings.Cut(path, "/blobs/")
+		data, ok := f.blobs[repo][digest.Digest(dgst)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repo string, ref string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		payload, ok := f.manifests[repo][ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		dgst := digest.FromBytes(payload)
+		if !f.omitDigest {
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+		}
+		w.Header().Set("Content-Type", f.types[dgst])
+		if r.Method == http.MethodGet {
+			f.manifestGets++
+			w.Write(payload)
+		}
+	case http.MethodPut:
+		payload, _ := io.ReadAll(r.Body)
+		if missing := f.missingReferences(repo, payload); missing != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"errors":[{"code":"MANIFEST_BLOB_UNKNOWN","message":"blob unknown to registry","detail":%q}]}`, missing)
+			return
+		}
+		dgst := digest.FromBytes(payload)
+		if f.manifests[repo] == nil {
+			f.manifests[repo] = make(map[string][]byte)
+		}
+		f.manifests[repo][ref] = payload
+		f.manifests[repo][dgst.String()] = payload
+		f.types[dgst] = r.Header.Get("Content-Type")
+		f.pushedManifests++
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// missingReferences returns a blob or manifest a manifest refers to which the
+// repository does not hold.
+func (f *fakeRegistry) missingReferences(repo string, payload []byte) string {
+	var manifest struct {
+		Config    struct{ Digest digest.Digest }
+		Layers    []struct{ Digest digest.Digest }
+		Manifests []struct{ Digest digest.Digest }
+	}
+	json.Unmarshal(payload, &manifest)
+	for _, child := range manifest.Manifests {
+		if _, ok := f.manifests[repo][child.Digest.String()]; !ok {
+			return child.Digest.String()
+		}
+	}
+	if len(manifest.Manifests) > 0 {
+		return ""
+	}
+	blobs := []digest.Digest{manifest.Config.Digest}
+	for _, layer := range manifest.Layers {
+		blobs = append(blobs, layer.Digest)
+	}
+	for _, dgst := range blobs {
+		if _, ok := f.blobs[repo][dgst]; !ok {
+			return dgst.String()
+		}
+	}
+	return ""
+}
+
+func (f *fakeRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repo string, id string) {
+	switch r.Method {
+	case http.MethodPost:
+		if mount := digest.Digest(r.URL.Query().Get("mount")); mount != "" {
+			if data, ok := f.blobs[r.URL.Query().Get("from")][mount]; ok {
+				f.blobEvents = append(f.blobEvents, fmt.Sprintf("mount %s from %s %s", repo, r.URL.Query().Get("from"), data))
+				f.putBlob(repo, data)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		f.sessions++
+		id := fmt.Sprint(f.sessions)
+		f.uploads[id] = nil
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		data, _ := io.ReadAll(r.Body)
+		f.uploads[id] = append(f.uploads[id], data...)
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		data = append(f.uploads[id], data...)
+		delete(f.uploads, id)
+		if digest.FromBytes(data).String() != r.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"provided digest did not match uploaded content"}]}`)
+			return
+		}
+		f.blobEvents = append(f.blobEvents, fmt.Sprintf("upload %s %s", repo, data))
+		f.putBlob(repo, data)
+		f.pushedBlobs++
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeRegistry) putBlob(repo string, data []byte) {
+	if f.blobs[repo] == nil {
+		f.blobs[repo] = make(map[digest.Digest][]byte)
+	}
+	f.blobs[repo][digest.FromBytes(data)] = data
+}
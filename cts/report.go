@@ -0,0 +1,89 @@
+package cts
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+type Status string
+
+const (
+	StatusSynced  Status = "synced"
+	StatusSkipped Status = "skipped"
+	StatusFailed  Status = "failed"
+	// StatusCanceled is an image that was not synced because the sync was
+	// aborted on the failure of another image.
+	StatusCanceled Status = "canceled"
+	// StatusPlanned is an image a dry run would have pushed.
+	StatusPlanned Status = "planned"
+	// StatusDeferred is an image left for the next sync by WithMaxImages or
+	// WithMaxRepositories.
+	StatusDeferred Status = "deferred"
+)
+
+type ImageResult struct {
+	Image string
+	// Destination is the repo:tag the image is pushed to, or the repository
+	// for an image given by digest only
+	Destination string
+	Status      Status
+	// Digest is the manifest digest of the image in the destination registry
+	Digest digest.Digest
+	Err    error
+}
+
+// Report is the outcome of a sync, one result per artifact in the order the
+// artifacts were given.
+type Report struct {
+	Images   []ImageResult
+	Duration time.Duration
+	// Deduped is the number of bytes not uploaded because images shared
+	// their blobs, which were uploaded once and mounted for the others.
+	Deduped int64
+}
+
+func (r *Report) Count(status Status) int {
+	n := 0
+	for _, result := range r.Images {
+		if result.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Err joins the errors of all failed images, it is nil when none failed.
+func (r *Report) Err() error {
+	var errs []error
+	for _, result := range r.Images {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("image %s: %w", result.Image, result.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d synced, %d skipped, %d failed, %d canceled in %ds",
+		r.Count(StatusSynced), r.Count(StatusSkipped), r.Count(StatusFailed), r.Count(StatusCanceled), int(r.Duration.Seconds()))
+	if n := r.Count(StatusPlanned); n > 0 {
+		fmt.Fprintf(&b, ", %d planned", n)
+	}
+	if n := r.Count(StatusDeferred); n > 0 {
+		fmt.Fprintf(&b, ", %d deferred", n)
+	}
+	if r.Deduped > 0 {
+		fmt.Fprintf(&b, ", %.2fMB saved by deduplication", float64(r.Deduped)/1024/1024)
+	}
+	for _, result := range r.Images {
+		if result.Status == StatusFailed {
+			fmt.Fprintf(&b, "\n  %s: %v", result.Image, result.Err)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,70 @@
+package cts
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luojun96/isync/registry"
+)
+
+func TestSyncStatuses(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want []Status
+	}{
+		{name: "fail fast", want: []Status{StatusCanceled, StatusFailed, StatusCanceled}},
+		{name: "continue on error", opts: []Option{WithContinueOnError()}, want: []Status{StatusSynced, StatusFailed, StatusSynced}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := newFakeRegistry(t), newFakeRegistry(t)
+			src.image("team/a", "v1", "a")
+			src.image("team/b", "v1", "b")
+			// the destination is slow, so that the missing image fails while
+			// the others are in flight
+			dst.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(100 * time.Millisecond)
+				dst.ServeHTTP(w, r)
+			})
+
+			artifacts := []string{"team/a:v1", "team/missing:v1", "team/b:v1"}
+			report, err := NewImageSync(src.client(), dst.client(), tt.opts...).Sync(context.Background(), artifacts)
+			if err == nil {
+				t.Fatal("sync succeeded")
+			}
+			if !errors.Is(err, registry.ErrorCodeManifestUnknown) {
+				t.Errorf("error %v, want the manifest unknown error of the missing image", err)
+			}
+			if err.Error() != report.Err().Error() {
+				t.Errorf("sync returned %v, report has %v", err, report.Err())
+			}
+			if strings.Contains(err.Error(), "team/a") || strings.Contains(err.Error(), "team/b") {
+				t.Errorf("error %v names the images that did not fail", err)
+			}
+
+			var statuses []Status
+			for _, result := range report.Images {
+				statuses = append(statuses, result.Status)
+			}
+			if len(statuses) != len(tt.want) {
+				t.Fatalf("statuses %v, want %v", statuses, tt.want)
+			}
+			for i, result := range report.Images {
+				if result.Image != artifacts[i] || result.Status != tt.want[i] {
+					t.Errorf("image %d is %s %s, want %s %s", i, result.Image, result.Status, artifacts[i], tt.want[i])
+				}
+				if (result.Err != nil) != (result.Status == StatusFailed) {
+					t.Errorf("image %s is %s with error %v", result.Image, result.Status, result.Err)
+				}
+				if synced := dst.manifest(strings.TrimSuffix(result.Image, ":v1"), "v1") != nil; synced != (result.Status == StatusSynced) {
+					t.Errorf("image %s is %s, pushed: %v", result.Image, result.Status, synced)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package cts
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/luojun96/isync/pool"
+	"github.com/luojun96/isync/registry"
+)
+
+// TagSelector selects tags of a repository. A tag is selected when it matches
+// one of Include and Globs, unless none is given, none of Exclude, and the
+// Semver range, if given. Latest then keeps the highest versions among them.
+type TagSelector struct {
+	// Include and Exclude are regular expressions matching whole tags
+	Include []string
+	Exclude []string
+	// Globs are patterns such as 1.2*, see path.Match
+	Globs []string
+	// Semver is a range of versions such as ">=1.20 <2", which tags that are
+	// no versions never match. Pre-releases, e.g. 1.25-alpine, only match
+	// ranges naming a pre-release.
+	Semver string
+	// Latest keeps the N highest versions, dropping the tags that are no
+	// versions, and pre-releases unless Semver selects them. Zero keeps all.
+	Latest int
+}
+
+// tagFilter is a compiled TagSelector.
+type tagFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	globs   []string
+	semver  *semver.Constraints
+	latest  int
+}
+
+// Validate reports an invalid pattern or range of the selector.
+func (s TagSelector) Validate() error {
+	_, err := s.compile()
+	return err
+}
+
+func (s TagSelector) compile() (*tagFilter, error) {
+	f := &tagFilter{globs: s.Globs, latest: s.Latest}
+	var err error
+	if f.include, err = compilePatterns("tag", s.Include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns("tag", s.Exclude); err != nil {
+		return nil, err
+	}
+	for _, glob := range s.Globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid tag glob %q: %w", glob, err)
+		}
+	}
+	if s.Semver != "" {
+		constraints, err := semver.NewConstraint(s.Semver)
+		if err != nil {
+			return nil, fmt.Errorf("invalid semver range %q: %w", s.Semver, err)
+		}
+		f.semver = constraints
+	}
+	if s.Latest < 0 {
+		return nil, fmt.Errorf("invalid latest %d, expected a positive number", s.Latest)
+	}
+	return f, nil
+}
+
+// Select returns the selected tags, in the order they are given.
+func (s TagSelector) Select(tags []string) ([]string, error) {
+	f, err := s.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []string
+	versions := make(map[string]*semver.Version)
+	for _, tag := range tags {
+		if !f.matches(tag) {
+			continue
+		}
+		if f.semver != nil || f.latest > 0 {
+			version, err := semver.NewVersion(tag)
+			if err != nil || f.semver != nil && !f.semver.Check(version) || f.semver == nil && version.Prerelease() != "" {
+				continue
+			}
+			versions[tag] = version
+		}
+		selected = append(selected, tag)
+	}
+	if f.latest == 0 || len(selected) <= f.latest {
+		return selected, nil
+	}
+
+	highest := append([]string{}, selected...)
+	sort.SliceStable(highest, func(i, j int) bool {
+		return versions[highest[i]].GreaterThan(versions[highest[j]])
+	})
+	latest := make(map[string]bool)
+	for _, tag := range highest[:f.latest] {
+		latest[tag] = true
+	}
+	var result []string
+	for _, tag := range selected {
+		if latest[tag] {
+			result = append(result, tag)
+		}
+	}
+	return result, nil
+}
+
+// compilePatterns compiles regular expressions of a kind of names, anchored at
+// both ends.
+func compilePatterns(kind string, patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", kind, pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func (f *tagFilter) matches(tag string) bool {
+	included := len(f.include) == 0 && len(f.globs) == 0
+	for _, re := range f.include {
+		included = included || re.MatchString(tag)
+	}
+	for _, glob := range f.globs {
+		ok, _ := path.Match(glob, tag)
+		included = included || ok
+	}
+	for _, re := range f.exclude {
+		if re.MatchString(tag) {
+			return false
+		}
+	}
+	return included
+}
+
+// RepositorySelector selects tags of a repository of the source registry.
+type RepositorySelector struct {
+	Repository string
+	Tags       TagSelector
+}
+
+// ExpandTags lists the tags of the repositories in the registry and returns
+// the selected ones as artifacts to sync, in the order of the selectors. A
+// repository whose tags cannot be listed or selected is left out: the error
+// joins the failures of those repositories and is returned along with the
+// artifacts of the others.
+func ExpandTags(ctx context.Context, r registry.Registry, selectors ...RepositorySelector) ([]string, error) {
+	expand := func(ctx context.Context, selector RepositorySelector) ([]string, error) {
+		tags, err := r.Tags(ctx, selector.Repository)
+		if err != nil {
+			return nil, fmt.Errorf("repository %s: %w", selector.Repository, err)
+		}
+		selected, err := selector.Tags.Select(tags)
+		if err != nil {
+			return nil, fmt.Errorf("repository %s: %w", selector.Repository, err)
+		}
+		log.Printf("repository %s: %d of %d tags selected.\n", selector.Repository, len(selected), len(tags))
+		return selected, nil
+	}
+
+	results, err := pool.Map(ctx, Concurrency, selectors, expand)
+	var artifacts []string
+	for i, result := range results {
+		for _, tag := range result.Value {
+			artifacts = append(artifacts, selectors[i].Repository+":"+tag)
+		}
+	}
+	return artifacts, err
+}
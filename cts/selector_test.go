@@ -0,0 +1,89 @@
+package cts
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTagSelectorSelect(t *testing.T) {
+	tags := []string{"latest", "1.19", "1.20.1", "1.21", "1.21-alpine", "1.22rc1", "1.22", "2.0.0-beta.1", "2.0", "stable"}
+	tests := []struct {
+		name     string
+		selector TagSelector
+		want     []string
+	}{
+		{"all", TagSelector{}, tags},
+		{"include", TagSelector{Include: []string{`1\.2\d`, "stable"}}, []string{"1.21", "1.22", "stable"}},
+		{"include anchored", TagSelector{Include: []string{"1"}}, nil},
+		{"exclude", TagSelector{Exclude: []string{".*-.*", ".*rc.*", "latest"}}, []string{"1.19", "1.20.1", "1.21", "1.22", "2.0", "stable"}},
+		{"glob", TagSelector{Globs: []string{"1.2*"}}, []string{"1.20.1", "1.21", "1.21-alpine", "1.22rc1", "1.22"}},
+		{"include or glob", TagSelector{Include: []string{"latest"}, Globs: []string{"2.*"}}, []string{"latest", "2.0.0-beta.1", "2.0"}},
+		{"exclude wins", TagSelector{Globs: []string{"1.2*"}, Exclude: []string{".*-alpine"}}, []string{"1.20.1", "1.21", "1.22rc1", "1.22"}},
+		{"semver", TagSelector{Semver: ">=1.20 <2"}, []string{"1.20.1", "1.21", "1.22"}},
+		{"semver pre-release", TagSelector{Semver: ">=2.0.0-0"}, []string{"2.0.0-beta.1", "2.0"}},
+		{"latest", TagSelector{Latest: 2}, []string{"1.22", "2.0"}},
+		{"latest in range", TagSelector{Semver: "<2", Latest: 2}, []string{"1.21", "1.22"}},
+		{"latest of fewer", TagSelector{Include: []string{"1.19"}, Latest: 3}, []string{"1.19"}},
+		{"latest in given order", TagSelector{Latest: 3}, []string{"1.21", "1.22", "2.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.selector.Select(tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Select() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagSelectorValidate(t *testing.T) {
+	tests := []TagSelector{
+		{Include: []string{"1.("}},
+		{Exclude: []string{"[a-"}},
+		{Globs: []string{"[1.2"}},
+		{Semver: ">=one"},
+		{Latest: -1},
+	}
+	for _, selector := range tests {
+		if err := selector.Validate(); err == nil {
+			t.Errorf("Validate(%+v) accepted an invalid selector", selector)
+		}
+		if _, err := selector.Select([]string{"1.0"}); err == nil {
+			t.Errorf("Select of %+v succeeded", selector)
+		}
+	}
+}
+
+func TestExpandTags(t *testing.T) {
+	src := newFakeRegistry(t)
+	for _, tag := range []string{"1.24", "1.25", "1.26", "latest"} {
+		src.image("library/nginx", tag, "nginx "+tag)
+	}
+	src.image("library/redis", "7", "redis 7")
+
+	artifacts, err := ExpandTags(context.Background(), src.client(),
+		RepositorySelector{Repository: "library/redis"},
+		RepositorySelector{Repository: "library/nginx", Tags: TagSelector{Semver: ">=1.25"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"library/redis:7", "library/nginx:1.25", "library/nginx:1.26"}
+	if !reflect.DeepEqual(artifacts, want) {
+		t.Errorf("ExpandTags() = %v, want %v", artifacts, want)
+	}
+
+	// an unknown repository fails alone
+	artifacts, err = ExpandTags(context.Background(), src.client(), RepositorySelector{Repository: "library/unknown"}, RepositorySelector{Repository: "library/redis"})
+	if err == nil || !strings.Contains(err.Error(), "library/unknown") {
+		t.Errorf("ExpandTags of an unknown repository returned %v", err)
+	}
+	if want := []string{"library/redis:7"}; !reflect.DeepEqual(artifacts, want) {
+		t.Errorf("ExpandTags() along an unknown repository = %v, want %v", artifacts, want)
+	}
+}
@@ -0,0 +1,92 @@
+package cts
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+)
+
+// CorruptionError reports a layer whose content read from the source
+// registry does not match the size or digest of its descriptor.
+type CorruptionError struct {
+	Image  string
+	Digest digest.Digest
+	// Offset is the number of bytes read when the corruption was detected.
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("layer %s of image %s is corrupted at byte %d: %s", e.Digest, e.Image, e.Offset, e.Reason)
+}
+
+// verifyingReader hashes and counts a layer on its way from the source to the
+// destination registry. It fails the read that detects a mismatch, so the
+// upload is aborted before the registry commits the blob.
+type verifyingReader struct {
+	r          io.Reader
+	image      string
+	descriptor distribution.Descriptor
+	digester   digest.Digester
+	offset     int64
+	err        *CorruptionError
+}
+
+func newVerifyingReader(r io.Reader, image string, descriptor distribution.Descriptor) *verifyingReader {
+	return &verifyingReader{
+		r:          r,
+		image:      image,
+		descriptor: descriptor,
+		digester:   descriptor.Digest.Algorithm().Digester(),
+	}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	n, err := v.r.Read(p)
+	if v.offset+int64(n) > v.descriptor.Size {
+		n = int(v.descriptor.Size - v.offset)
+		v.digester.Hash().Write(p[:n])
+		v.offset += int64(n)
+		return n, v.corrupted(fmt.Sprintf("more than the expected %d bytes", v.descriptor.Size))
+	}
+	v.digester.Hash().Write(p[:n])
+	v.offset += int64(n)
+	if err == nil {
+		return n, nil
+	}
+
+	// the source may fail the stream on its own once it is complete, e.g.
+	// on a digest mismatch, check the content before passing the error on
+	if v.offset == v.descriptor.Size {
+		if got := v.digester.Digest(); got != v.descriptor.Digest {
+			return n, v.corrupted(fmt.Sprintf("digest %s does not match", got))
+		}
+	}
+	if errors.Is(err, io.EOF) && v.offset < v.descriptor.Size {
+		return n, v.corrupted(fmt.Sprintf("stream ended before the expected %d bytes", v.descriptor.Size))
+	}
+	return n, err
+}
+
+// verified reports whether the whole layer has been read and matches its
+// descriptor.
+func (v *verifyingReader) verified() bool {
+	return v.err == nil && v.offset == v.descriptor.Size && v.digester.Digest() == v.descriptor.Digest
+}
+
+func (v *verifyingReader) corrupted(reason string) *CorruptionError {
+	v.err = &CorruptionError{
+		Image:  v.image,
+		Digest: v.descriptor.Digest,
+		Offset: v.offset,
+		Reason: reason,
+	}
+	return v.err
+}
@@ -0,0 +1,50 @@
+package cts
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	content := "0123456789"
+	descriptor := distribution.Descriptor{Digest: digest.FromString(content), Size: int64(len(content))}
+	tests := []struct {
+		name   string
+		stream string
+		offset int64
+		ok     bool
+	}{
+		{"intact", content, 10, true},
+		{"truncated", content[:6], 6, false},
+		{"too long", content + "x", 10, false},
+		{"altered", "012345678x", 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVerifyingReader(strings.NewReader(tt.stream), "library/app:1", descriptor)
+			_, err := io.ReadAll(v)
+
+			var corruption *CorruptionError
+			if tt.ok {
+				if err != nil || !v.verified() {
+					t.Fatalf("intact layer: %v, verified %v", err, v.verified())
+				}
+				return
+			}
+			if !errors.As(err, &corruption) {
+				t.Fatalf("corrupted layer: %v, want a CorruptionError", err)
+			}
+			if corruption.Offset != tt.offset || corruption.Digest != descriptor.Digest {
+				t.Errorf("corruption at %d of %s, want %d of %s", corruption.Offset, corruption.Digest, tt.offset, descriptor.Digest)
+			}
+			if v.verified() {
+				t.Error("corrupted layer verified")
+			}
+		})
+	}
+}
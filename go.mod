@@ -3,14 +3,14 @@ module github.com/luojun96/isync
 go 1.21.0
 
 require (
+	github.com/Masterminds/semver/v3 v3.3.1
 	github.com/distribution/distribution v2.8.3+incompatible
+	github.com/distribution/reference v0.5.0
 	github.com/docker/distribution v2.8.3+incompatible
 	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.1.0
 	golang.org/x/net v0.22.0
 	golang.org/x/sync v0.6.0
-)
-
-require (
-	github.com/distribution/reference v0.5.0 // indirect
-	github.com/opencontainers/image-spec v1.1.0 // indirect
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
 )
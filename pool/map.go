@@ -0,0 +1,49 @@
+package pool
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrSkipped is the error of the items Map did not call its function for,
+// because ctx was done or another item failed in fail fast mode.
+var ErrSkipped = errors.New("task skipped")
+
+type Result[T any] struct {
+	Value T
+	Err   error
+}
+
+type funcTask[I, O any] struct {
+	item   I
+	f      func(ctx context.Context, item I) (O, error)
+	result *Result[O]
+}
+
+func (t *funcTask[I, O]) Execute(ctx context.Context) error {
+	t.result.Value, t.result.Err = t.f(ctx, t.item)
+	return t.result.Err
+}
+
+// Map calls f for every item, at most maxWorkers at a time but at least one,
+// and returns the results in the order of the items along with the error Run
+// returns.
+func Map[I, O any](ctx context.Context, maxWorkers int, items []I, f func(ctx context.Context, item I) (O, error), opts ...Option) ([]Result[O], error) {
+	results := make([]Result[O], len(items))
+	p := NewWorkPool(maxWorkers, opts...)
+	for i, item := range items {
+		results[i].Err = ErrSkipped
+		p.AddTask(&funcTask[I, O]{item: item, f: f, result: &results[i]})
+	}
+	err := p.Run(ctx)
+	return results, err
+}
+
+// ForEach calls f for every item, at most maxWorkers at a time, and returns
+// the errors of the items joined in their order.
+func ForEach[I any](ctx context.Context, maxWorkers int, items []I, f func(ctx context.Context, item I) error, opts ...Option) error {
+	_, err := Map(ctx, maxWorkers, items, func(ctx context.Context, item I) (struct{}, error) {
+		return struct{}{}, f(ctx, item)
+	}, opts...)
+	return err
+}
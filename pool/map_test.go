@@ -0,0 +1,90 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMap(t *testing.T) {
+	failure := errors.New("failure")
+	tests := []struct {
+		name       string
+		maxWorkers int
+		opts       []Option
+		// wantErrs holds the error of every item, nil for the items squared
+		wantErrs []error
+	}{
+		{"in order", 3, nil, []error{nil, nil, nil, failure, nil, nil}},
+		{"no workers", 0, nil, []error{nil, nil, nil, failure, nil, nil}},
+		{"negative workers", -1, nil, []error{nil, nil, nil, failure, nil, nil}},
+		{"fail fast", 1, []Option{WithFailFast()}, []error{nil, nil, nil, failure, ErrSkipped, ErrSkipped}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := []int{0, 1, 2, 3, 4, 5}
+			done := make(chan struct{})
+			var results []Result[int]
+			var err error
+			go func() {
+				defer close(done)
+				results, err = Map(context.Background(), tt.maxWorkers, items, func(ctx context.Context, i int) (int, error) {
+					// the later items finish first
+					time.Sleep(time.Duration(len(items)-i) * time.Millisecond)
+					if i == 3 {
+						return 0, failure
+					}
+					return i * i, nil
+				}, tt.opts...)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Map hangs")
+			}
+
+			if !errors.Is(err, failure) || errors.Is(err, ErrSkipped) {
+				t.Errorf("Map() error = %v, want the failure only", err)
+			}
+			for i, r := range results {
+				if !errors.Is(r.Err, tt.wantErrs[i]) || tt.wantErrs[i] == nil && r.Err != nil {
+					t.Errorf("item %d: error %v, want %v", i, r.Err, tt.wantErrs[i])
+				}
+				if r.Err == nil && r.Value != i*i {
+					t.Errorf("item %d: value %d, want %d", i, r.Value, i*i)
+				}
+			}
+		})
+	}
+}
+
+func TestMapContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, err := Map(ctx, 1, []int{0, 1, 2}, func(ctx context.Context, i int) (int, error) {
+		cancel()
+		return i, nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Map() error = %v, want context.Canceled", err)
+	}
+	for i, want := range []error{nil, ErrSkipped, ErrSkipped} {
+		if results[i].Err != want {
+			t.Errorf("item %d: error %v, want %v", i, results[i].Err, want)
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	err := ForEach(context.Background(), 0, []int{0, 1, 2, 3}, func(ctx context.Context, i int) error {
+		if i%2 == 1 {
+			return fmt.Errorf("item %d", i)
+		}
+		return nil
+	})
+	if want := "item 1\nitem 3"; err == nil || err.Error() != want {
+		t.Errorf("ForEach() = %v, want %q", err, want)
+	}
+}
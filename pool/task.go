@@ -3,5 +3,5 @@ package pool
 import "context"
 
 type Task interface {
-	Execute(ctx context.Context)
+	Execute(ctx context.Context) error
 }
@@ -2,47 +2,92 @@ package pool
 
 import (
 	"context"
-	"log"
+	"errors"
 
 	"golang.org/x/sync/semaphore"
 )
 
 type Pool interface {
-	Run(ctx context.Context)
+	Run(ctx context.Context) error
 }
 
 type WorkPool struct {
-	size  int64
-	sem   *semaphore.Weighted
-	tasks []Task
+	size     int64
+	sem      *semaphore.Weighted
+	tasks    []Task
+	failFast bool
 }
 
-func NewWorkPool(maxWorkers int) *WorkPool {
-	return &WorkPool{
+type Option func(*WorkPool)
+
+// WithFailFast cancels the context of the running tasks and skips the tasks
+// not started yet once a task fails.
+func WithFailFast() Option {
+	return func(p *WorkPool) {
+		p.failFast = true
+	}
+}
+
+// NewWorkPool returns a pool running at most maxWorkers tasks at a time, at
+// least one.
+func NewWorkPool(maxWorkers int, opts ...Option) *WorkPool {
+	maxWorkers = max(maxWorkers, 1)
+	p := &WorkPool{
 		size:  int64(maxWorkers),
 		sem:   semaphore.NewWeighted(int64(maxWorkers)),
 		tasks: make([]Task, 0),
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
 func (p *WorkPool) AddTask(task Task) {
 	p.tasks = append(p.tasks, task)
 }
 
-func (p *WorkPool) Run(ctx context.Context) {
-	for _, task := range p.tasks {
-		if err := p.sem.Acquire(ctx, 1); err != nil {
-			log.Printf("failed to acquire semaphore: %v", err)
+// Run executes the tasks and returns their errors joined in the order the
+// tasks were added. When ctx is done, the tasks not started yet are skipped
+// and the error of ctx is returned along with the errors of the tasks.
+// Tasks canceled in fail fast mode do not contribute their errors.
+func (p *WorkPool) Run(ctx context.Context) error {
+	taskCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]error, len(p.tasks)+1)
+	for i, task := range p.tasks {
+		if p.sem.Acquire(taskCtx, 1) != nil {
+			errs[len(p.tasks)] = ctx.Err()
+			break
+		}
+		// Acquire may grant a worker freed right after ctx was canceled
+		if taskCtx.Err() != nil {
+			p.sem.Release(1)
+			errs[len(p.tasks)] = ctx.Err()
 			break
 		}
 
-		go func(task Task) {
+		go func(i int, task Task) {
 			defer p.sem.Release(1)
-			task.Execute(ctx)
-		}(task)
+			err := task.Execute(taskCtx)
+			if err == nil {
+				return
+			}
+			if p.failFast && taskCtx.Err() != nil && ctx.Err() == nil && errors.Is(err, context.Canceled) {
+				return
+			}
+			errs[i] = err
+			if p.failFast {
+				cancel()
+			}
+		}(i, task)
 	}
 
-	if err := p.sem.Acquire(ctx, p.size); err != nil {
-		log.Printf("failed to acquire semaphore: %v", err)
+	// wait for the running tasks even when ctx is done, they return soon after
+	if err := p.sem.Acquire(context.Background(), p.size); err != nil {
+		return err
 	}
+	p.sem.Release(p.size)
+	return errors.Join(errs...)
 }
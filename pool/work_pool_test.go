@@ -0,0 +1,107 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// taskFunc adapts a function to a Task.
+type taskFunc func(ctx context.Context) error
+
+func (f taskFunc) Execute(ctx context.Context) error {
+	return f(ctx)
+}
+
+func TestRunJoinsErrorsInOrder(t *testing.T) {
+	p := NewWorkPool(3)
+	var running, peak atomic.Int32
+	for i := 0; i < 10; i++ {
+		i := i
+		p.AddTask(taskFunc(func(ctx context.Context) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				old := peak.Load()
+				if n <= old || peak.CompareAndSwap(old, n) {
+					break
+				}
+			}
+			// the later tasks finish first
+			time.Sleep(time.Duration(10-i) * time.Millisecond)
+			if i%3 == 0 {
+				return fmt.Errorf("task %d", i)
+			}
+			return nil
+		}))
+	}
+
+	err := p.Run(context.Background())
+	if want := "task 0\ntask 3\ntask 6\ntask 9"; err == nil || err.Error() != want {
+		t.Errorf("Run() = %v, want %q", err, want)
+	}
+	if peak.Load() > 3 {
+		t.Errorf("%d tasks ran at once, want at most 3", peak.Load())
+	}
+}
+
+func TestRunFailFast(t *testing.T) {
+	failure := errors.New("failure")
+	p := NewWorkPool(2, WithFailFast())
+	var started atomic.Int32
+	canceled := make(chan struct{})
+	p.AddTask(taskFunc(func(ctx context.Context) error {
+		started.Add(1)
+		<-ctx.Done()
+		close(canceled)
+		return ctx.Err()
+	}))
+	p.AddTask(taskFunc(func(ctx context.Context) error {
+		started.Add(1)
+		return failure
+	}))
+	for i := 0; i < 5; i++ {
+		p.AddTask(taskFunc(func(ctx context.Context) error {
+			started.Add(1)
+			return nil
+		}))
+	}
+
+	err := p.Run(context.Background())
+	// the task canceled by the failure does not report its cancellation
+	if !errors.Is(err, failure) || errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want only the failure", err)
+	}
+	select {
+	case <-canceled:
+	default:
+		t.Error("running task not canceled")
+	}
+	if started.Load() != 2 {
+		t.Errorf("%d tasks started, want the 2 before the failure", started.Load())
+	}
+}
+
+func TestRunContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := NewWorkPool(1)
+	var started atomic.Int32
+	for i := 0; i < 3; i++ {
+		p.AddTask(taskFunc(func(context.Context) error {
+			started.Add(1)
+			cancel()
+			return nil
+		}))
+	}
+
+	if err := p.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() = %v, want context.Canceled", err)
+	}
+	if started.Load() != 1 {
+		t.Errorf("%d tasks started after ctx was done, want 1", started.Load())
+	}
+}
@@ -0,0 +1,201 @@
+package progress
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/luojun96/isync/throttle"
+	"github.com/opencontainers/go-digest"
+)
+
+// rateWindow is how far back the transfer rate is measured
+const rateWindow = 5 * time.Second
+
+type Status string
+
+const (
+	StatusWaiting      Status = "waiting"
+	StatusTransferring Status = "transferring"
+	// StatusExists is a blob the destination registry held before the sync
+	StatusExists Status = "exists"
+	// StatusMounted is a blob mounted from another repository instead of
+	// transferred
+	StatusMounted Status = "mounted"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Event is the progress of a blob synced for an image.
+type Event struct {
+	Image       string        `json:"image"`
+	Digest      digest.Digest `json:"digest"`
+	Size        int64         `json:"size"`
+	Transferred int64         `json:"transferred"`
+	Status      Status        `json:"status"`
+	Error       string        `json:"error,omitempty"`
+	Time        time.Time     `json:"time"`
+}
+
+type Bandwidth struct {
+	Name string `json:"name"`
+	// Rate is in bytes per second
+	Rate float64 `json:"rate"`
+	// Limit is in bytes per second, zero when there is none
+	Limit int64 `json:"limit"`
+}
+
+// Snapshot aggregates the blobs of a sync at a point in time. Total and
+// Transferred count the blobs that are, or were, transferred.
+type Snapshot struct {
+	Blobs       []Event       `json:"blobs,omitempty"`
+	Total       int64         `json:"total"`
+	Transferred int64         `json:"transferred"`
+	Rate        float64       `json:"rate"`
+	ETA         time.Duration `json:"eta"`
+	Elapsed     time.Duration `json:"elapsed"`
+	Bandwidth   []Bandwidth   `json:"bandwidth,omitempty"`
+}
+
+// Count returns the number of blobs in status.
+func (s Snapshot) Count(status Status) int {
+	n := 0
+	for _, blob := range s.Blobs {
+		if blob.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+type key struct {
+	image  string
+	digest digest.Digest
+}
+
+type sample struct {
+	time  time.Time
+	bytes int64
+}
+
+// Tracker follows the blobs of a sync, renderers take snapshots of it.
+type Tracker struct {
+	bandwidth []*throttle.Limiter
+
+	mu      sync.Mutex
+	start   time.Time
+	blobs   map[key]*Event
+	order   []key
+	bytes   int64
+	samples []sample
+}
+
+// NewTracker creates a tracker that reports the rates of the bandwidth
+// limiters along with its own.
+func NewTracker(bandwidth ...*throttle.Limiter) *Tracker {
+	t := &Tracker{
+		start: time.Now(),
+		blobs: make(map[key]*Event),
+	}
+	for _, limiter := range bandwidth {
+		if limiter != nil {
+			t.bandwidth = append(t.bandwidth, limiter)
+		}
+	}
+	return t
+}
+
+// Update records the status of a blob of an image.
+func (t *Tracker) Update(image string, dgst digest.Digest, size int64, status Status, err error) {
+	t.mu.Lock()
+	e := t.blob(image, dgst, size)
+	e.Status = status
+	e.Time = time.Now()
+	if status == StatusDone {
+		e.Transferred = e.Size
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.mu.Unlock()
+}
+
+// blob returns the event of a blob, the caller holds t.mu.
+func (t *Tracker) blob(image string, dgst digest.Digest, size int64) *Event {
+	k := key{image: image, digest: dgst}
+	e, ok := t.blobs[k]
+	if !ok {
+		e = &Event{Image: image, Digest: dgst, Size: size}
+		t.blobs[k] = e
+		t.order = append(t.order, k)
+	}
+	return e
+}
+
+// Reader counts the bytes of a blob of an image read through r, starting the
+// transfer of the blob over.
+func (t *Tracker) Reader(r io.Reader, image string, dgst digest.Digest, size int64) io.Reader {
+	t.mu.Lock()
+	e := t.blob(image, dgst, size)
+	e.Status = StatusTransferring
+	e.Transferred = 0
+	e.Time = time.Now()
+	t.mu.Unlock()
+	return &countingReader{r: r, tracker: t, key: key{image: image, digest: dgst}}
+}
+
+type countingReader struct {
+	r       io.Reader
+	tracker *Tracker
+	key     key
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	t := c.tracker
+	t.mu.Lock()
+	t.bytes += int64(n)
+	e := t.blobs[c.key]
+	e.Transferred += int64(n)
+	e.Time = time.Now()
+	t.mu.Unlock()
+	return n, err
+}
+
+// Snapshot aggregates the blobs as of now.
+func (t *Tracker) Snapshot() Snapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	s := Snapshot{Elapsed: now.Sub(t.start)}
+	for _, k := range t.order {
+		e := *t.blobs[k]
+		s.Blobs = append(s.Blobs, e)
+		switch e.Status {
+		case StatusWaiting, StatusTransferring, StatusDone, StatusFailed:
+			s.Total += e.Size
+			s.Transferred += min(e.Transferred, e.Size)
+		}
+	}
+
+	t.samples = append(t.samples, sample{time: now, bytes: t.bytes})
+	for len(t.samples) > 2 && now.Sub(t.samples[0].time) > rateWindow {
+		t.samples = t.samples[1:]
+	}
+	if first := t.samples[0]; now.Sub(first.time) > 0 {
+		s.Rate = float64(t.bytes-first.bytes) / now.Sub(first.time).Seconds()
+	}
+	if s.Rate > 0 {
+		s.ETA = time.Duration(float64(s.Total-s.Transferred) / s.Rate * float64(time.Second))
+	}
+
+	for _, limiter := range t.bandwidth {
+		s.Bandwidth = append(s.Bandwidth, Bandwidth{Name: limiter.Name(), Rate: limiter.Rate(), Limit: limiter.Limit()})
+	}
+	return s
+}
@@ -0,0 +1,136 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestSnapshot(t *testing.T) {
+	tracker := NewTracker()
+	blob := func(name string) digest.Digest { return digest.FromString(name) }
+	tracker.Update("app:v1", blob("done"), 100, StatusDone, nil)
+	tracker.Update("app:v1", blob("exists"), 50, StatusExists, nil)
+	tracker.Update("app:v1", blob("mounted"), 70, StatusMounted, nil)
+	tracker.Update("app:v1", blob("waiting"), 20, StatusWaiting, nil)
+	r := tracker.Reader(strings.NewReader(strings.Repeat("x", 30)), "app:v1", blob("transferring"), 100)
+	io.ReadAll(r)
+	r = tracker.Reader(strings.NewReader(strings.Repeat("x", 10)), "app:v1", blob("failed"), 40)
+	io.ReadAll(r)
+	tracker.Update("app:v1", blob("failed"), 40, StatusFailed, errors.New("broken"))
+
+	s := tracker.Snapshot()
+	// the blobs that exist or were mounted are not transferred
+	if s.Total != 260 || s.Transferred != 140 {
+		t.Errorf("%d of %d bytes transferred, want 140 of 260", s.Transferred, s.Total)
+	}
+	counts := map[Status]int{StatusDone: 1, StatusExists: 1, StatusMounted: 1, StatusWaiting: 1, StatusTransferring: 1, StatusFailed: 1}
+	for status, want := range counts {
+		if got := s.Count(status); got != want {
+			t.Errorf("%d blobs %s, want %d", got, status, want)
+		}
+	}
+	if len(s.Blobs) != 6 || s.Blobs[0].Digest != blob("done") || s.Blobs[5].Error != "broken" {
+		t.Errorf("blobs %+v, want them in the order they were first seen", s.Blobs)
+	}
+	// the first snapshot has nothing to measure the rate against
+	if s.Rate != 0 || s.ETA != 0 {
+		t.Errorf("first snapshot at %.1fB/s, ETA %v, want no rate", s.Rate, s.ETA)
+	}
+
+	// the 40 bytes read were read over the last 2s
+	tracker.mu.Lock()
+	tracker.samples = []sample{{time: time.Now().Add(-2 * time.Second), bytes: 0}}
+	tracker.mu.Unlock()
+	s = tracker.Snapshot()
+	if s.Rate < 19 || s.Rate > 20 {
+		t.Errorf("rate %.1fB/s, want 20B/s", s.Rate)
+	}
+	if s.ETA < 6*time.Second || s.ETA > 6300*time.Millisecond {
+		t.Errorf("ETA %v, want 6s for 120 bytes at 20B/s", s.ETA)
+	}
+
+	// a transfer started over counts from zero again
+	tracker.Reader(strings.NewReader(""), "app:v1", blob("transferring"), 100)
+	if s := tracker.Snapshot(); s.Transferred != 110 {
+		t.Errorf("%d bytes transferred after starting a transfer over, want 110", s.Transferred)
+	}
+}
+
+func testSnapshot() Snapshot {
+	return Snapshot{
+		Blobs: []Event{
+			{Image: "app:v1", Digest: digest.FromString("done"), Size: 2048, Transferred: 2048, Status: StatusDone},
+			{Image: "app:v1", Digest: digest.FromString("transferring"), Size: 2048, Transferred: 512, Status: StatusTransferring},
+			{Image: "app:v1", Digest: digest.FromString("mounted"), Size: 1024, Status: StatusMounted},
+		},
+		Total:       4096,
+		Transferred: 2560,
+		Rate:        512,
+		ETA:         3 * time.Second,
+		Elapsed:     5 * time.Second,
+	}
+}
+
+func TestTTYRender(t *testing.T) {
+	var out bytes.Buffer
+	tty := NewTTY(&out)
+	tty.Render(testSnapshot())
+	want := []string{
+		"blobs: 1 transferring, 0 waiting, 1 done, 1 mounted, 0 exist, 0 failed",
+		"2.5KiB / 4.0KiB (62%) at 512B/s, ETA 3s, elapsed 5s",
+		"  app:v1 " + digest.FromString("transferring").Encoded()[:12] + " [=====               ]  25% 512B/2.0KiB",
+	}
+	if got := out.String(); got != strings.Join(want, "\n")+"\n" {
+		t.Errorf("rendered\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+
+	// the log is written over the frame, which is drawn again below it
+	out.Reset()
+	tty.Write([]byte("pushed layer\n"))
+	if got, wantPrefix := out.String(), "\x1b[3A\x1b[Jpushed layer\n"+want[0]; !strings.HasPrefix(got, wantPrefix) {
+		t.Errorf("wrote %q, want it to start with %q", got, wantPrefix)
+	}
+
+	out.Reset()
+	done := testSnapshot()
+	done.Blobs, done.Transferred = done.Blobs[:1], done.Total
+	tty.Render(done)
+	if got := out.String(); !strings.HasPrefix(got, "\x1b[3A\x1b[J") || !strings.Contains(got, "(100%) at 512B/s, ETA 0s") {
+		t.Errorf("rendered %q, want the last frame cleared and the transfer done", got)
+	}
+}
+
+func TestJSONRender(t *testing.T) {
+	var out bytes.Buffer
+	NewJSON(&out).Render(testSnapshot())
+
+	var line jsonLine
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("rendered %q: %v", out.String(), err)
+	}
+	if line.Total != 4096 || line.Transferred != 2560 || line.Rate != 512 || line.ETASeconds != 3 || line.ElapsedSeconds != 5 {
+		t.Errorf("rendered %+v", line)
+	}
+	want := map[Status]int{StatusDone: 1, StatusTransferring: 1, StatusMounted: 1}
+	if len(line.Blobs) != len(want) {
+		t.Errorf("blob counts %v, want %v", line.Blobs, want)
+	}
+	for status, n := range want {
+		if line.Blobs[status] != n {
+			t.Errorf("blob counts %v, want %v", line.Blobs, want)
+		}
+	}
+	if len(line.Transfers) != 1 || line.Transfers[0].Digest != digest.FromString("transferring") {
+		t.Errorf("transfers %+v, want the transferring blob only", line.Transfers)
+	}
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("rendered %q, want a single line", out.String())
+	}
+}
@@ -0,0 +1,203 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luojun96/isync/throttle"
+)
+
+const (
+	// maxTransfers is the number of transfers the TTY renderer lists
+	maxTransfers = 10
+	barWidth     = 20
+)
+
+type Renderer interface {
+	Render(s Snapshot)
+}
+
+// Start renders the snapshots of the tracker every interval until the
+// returned function is called, which renders a last snapshot and waits for
+// it.
+func Start(t *Tracker, r Renderer, interval time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.Render(t.Snapshot())
+			case <-stop:
+				r.Render(t.Snapshot())
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// IsTerminal reports whether f is a terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// TTY redraws the progress in place on a terminal. It is also a writer for
+// the log, which it prints above the progress.
+type TTY struct {
+	mu    sync.Mutex
+	w     io.Writer
+	frame []string
+}
+
+func NewTTY(w io.Writer) *TTY {
+	return &TTY{w: w}
+}
+
+func (t *TTY) Render(s Snapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clear()
+	t.frame = frame(s)
+	t.draw()
+}
+
+func (t *TTY) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clear()
+	n, err := t.w.Write(p)
+	t.draw()
+	return n, err
+}
+
+// clear erases the frame drawn last, the caller holds t.mu.
+func (t *TTY) clear() {
+	if len(t.frame) > 0 {
+		fmt.Fprintf(t.w, "\x1b[%dA\x1b[J", len(t.frame))
+	}
+}
+
+func (t *TTY) draw() {
+	for _, line := range t.frame {
+		fmt.Fprintln(t.w, line)
+	}
+}
+
+func frame(s Snapshot) []string {
+	lines := []string{
+		fmt.Sprintf("blobs: %d transferring, %d waiting, %d done, %d mounted, %d exist, %d failed",
+			s.Count(StatusTransferring), s.Count(StatusWaiting), s.Count(StatusDone), s.Count(StatusMounted), s.Count(StatusExists), s.Count(StatusFailed)),
+		fmt.Sprintf("%s / %s (%d%%) at %s/s, ETA %s, elapsed %s",
+			throttle.FormatBytes(s.Transferred), throttle.FormatBytes(s.Total), percent(s.Transferred, s.Total),
+			throttle.FormatBytes(int64(s.Rate)), eta(s), s.Elapsed.Round(time.Second)),
+	}
+	if len(s.Bandwidth) > 0 {
+		var limits []string
+		for _, b := range s.Bandwidth {
+			limit := "unlimited"
+			if b.Limit > 0 {
+				limit = throttle.FormatBytes(b.Limit) + "/s"
+			}
+			limits = append(limits, fmt.Sprintf("%s %s/s of %s", b.Name, throttle.FormatBytes(int64(b.Rate)), limit))
+		}
+		lines = append(lines, "bandwidth: "+strings.Join(limits, ", "))
+	}
+
+	listed := 0
+	for _, blob := range s.Blobs {
+		if blob.Status != StatusTransferring {
+			continue
+		}
+		if listed == maxTransfers {
+			lines = append(lines, fmt.Sprintf("  ... %d more", s.Count(StatusTransferring)-listed))
+			break
+		}
+		filled := int(int64(barWidth) * min(blob.Transferred, blob.Size) / max(blob.Size, 1))
+		lines = append(lines, fmt.Sprintf("  %s %s [%s%s] %3d%% %s/%s", blob.Image, shortDigest(blob),
+			strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), percent(blob.Transferred, blob.Size),
+			throttle.FormatBytes(blob.Transferred), throttle.FormatBytes(blob.Size)))
+		listed++
+	}
+	return lines
+}
+
+func shortDigest(blob Event) string {
+	encoded := blob.Digest.Encoded()
+	return encoded[:min(12, len(encoded))]
+}
+
+func percent(n int64, total int64) int64 {
+	if total <= 0 {
+		return 100
+	}
+	return min(n, total) * 100 / total
+}
+
+func eta(s Snapshot) string {
+	if s.Transferred >= s.Total {
+		return "0s"
+	}
+	if s.ETA == 0 {
+		return "unknown"
+	}
+	return s.ETA.Round(time.Second).String()
+}
+
+// JSON writes the progress as a JSON object per line, for logs that are not
+// read on a terminal.
+type JSON struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{enc: json.NewEncoder(w)}
+}
+
+type jsonLine struct {
+	Time           time.Time      `json:"time"`
+	ElapsedSeconds float64        `json:"elapsed_seconds"`
+	Total          int64          `json:"total"`
+	Transferred    int64          `json:"transferred"`
+	Rate           float64        `json:"rate"`
+	ETASeconds     float64        `json:"eta_seconds"`
+	Blobs          map[Status]int `json:"blobs"`
+	Transfers      []Event        `json:"transfers,omitempty"`
+	Bandwidth      []Bandwidth    `json:"bandwidth,omitempty"`
+}
+
+func (j *JSON) Render(s Snapshot) {
+	line := jsonLine{
+		Time:           time.Now(),
+		ElapsedSeconds: s.Elapsed.Seconds(),
+		Total:          s.Total,
+		Transferred:    s.Transferred,
+		Rate:           s.Rate,
+		ETASeconds:     s.ETA.Seconds(),
+		Blobs:          make(map[Status]int),
+		Bandwidth:      s.Bandwidth,
+	}
+	for _, blob := range s.Blobs {
+		line.Blobs[blob.Status]++
+		if blob.Status == StatusTransferring {
+			line.Transfers = append(line.Transfers, blob)
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(line)
+}
@@ -4,17 +4,18 @@ import (
 	"context"
 	"io"
 
-	manifestV2 "github.com/distribution/distribution/manifest/schema2"
 	"github.com/opencontainers/go-digest"
 )
 
 type Registry interface {
 	Ping() error
-	ManifestV2(ctx context.Context, repo string, ref string) (manifestV2.DeserializedManifest, error)
-	ManifestV2Exists(ctx context.Context, repo string, ref string) (bool, error)
-	ManifestV2Put(ctx context.Context, repo string, ref string, manifest manifestV2.DeserializedManifest) error
+	Manifest(ctx context.Context, repo string, ref string) (Manifest, error)
+	ManifestV2Exists(ctx context.Context, repo string, ref string) (bool, digest.Digest, error)
+	ManifestPut(ctx context.Context, repo string, ref string, manifest Manifest) error
 	LayerExists(ctx context.Context, repo string, digest digest.Digest) (bool, error)
 	LayerDownload(ctx context.Context, repo string, digest digest.Digest) (io.ReadCloser, error)
 	LayerUpload(ctx context.Context, repo string, digest digest.Digest, reader io.Reader) error
-	LayerMount(ctx context.Context, repo string, digest digest.Digest) error
+	LayerMount(ctx context.Context, repo string, from string, digest digest.Digest) error
+	Tags(ctx context.Context, repo string) ([]string, error)
+	Catalog(ctx context.Context) ([]string, error)
 }
@@ -0,0 +1,353 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tokens without expires_in are valid for 60 seconds per the token spec
+	defaultTokenExpiry = 60 * time.Second
+	tokenExpiryMargin  = 10 * time.Second
+)
+
+type Credential struct {
+	Username string
+	Password string
+	// IdentityToken is exchanged for access tokens with the OAuth2 refresh_token grant
+	IdentityToken string
+}
+
+func (c Credential) empty() bool {
+	return c.Username == "" && c.Password == "" && c.IdentityToken == ""
+}
+
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+type token struct {
+	value     string
+	expiresAt time.Time
+}
+
+func (t token) valid() bool {
+	return t.value != "" && time.Now().Before(t.expiresAt)
+}
+
+// authTransport answers the WWW-Authenticate challenges of a registry with
+// either bearer tokens, cached per scope, or basic auth.
+type authTransport struct {
+	base       http.RoundTripper
+	host       string
+	credential Credential
+	// debug logs the token requests, nil drops them
+	debug *log.Logger
+
+	mu        sync.Mutex
+	challenge *challenge
+	tokens    map[string]token
+}
+
+func newAuthTransport(base http.RoundTripper, host string, credential Credential, debug *log.Logger) *authTransport {
+	return &authTransport{
+		base:       base,
+		host:       host,
+		credential: credential,
+		debug:      debug,
+		tokens:     make(map[string]token),
+	}
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// never leak registry credentials to blob storage the registry redirects to
+	if req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+
+	scopes := scopesFor(req)
+	authReq, err := t.authorize(req, scopes, false)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(authReq)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	c, ok := parseChallenge(resp.Header.Values("WWW-Authenticate"))
+	if !ok || !replayable(req) {
+		return resp, nil
+	}
+	t.mu.Lock()
+	t.challenge = c
+	t.mu.Unlock()
+
+	retryReq, err := t.authorize(req, scopes, true)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if retryReq == authReq {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return t.base.RoundTrip(retryReq)
+}
+
+func (t *authTransport) authorize(req *http.Request, scopes []string, refresh bool) (*http.Request, error) {
+	t.mu.Lock()
+	c := t.challenge
+	t.mu.Unlock()
+	if c == nil {
+		return req, nil
+	}
+
+	var header string
+	switch c.scheme {
+	case "basic":
+		if t.credential.Username == "" && t.credential.Password == "" {
+			return req, nil
+		}
+		header = "Basic " + basicAuth(t.credential)
+	case "bearer":
+		tk, err := t.token(req, c, scopes, refresh)
+		if err != nil {
+			return nil, err
+		}
+		header = "Bearer " + tk
+	default:
+		return req, nil
+	}
+
+	authReq := req.Clone(req.Context())
+	if req.Body != nil && req.GetBody != nil && refresh {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		authReq.Body = body
+	}
+	authReq.Header.Set("Authorization", header)
+	return authReq, nil
+}
+
+func (t *authTransport) token(req *http.Request, c *challenge, scopes []string, refresh bool) (string, error) {
+	key := strings.Join(scopes, " ")
+	t.mu.Lock()
+	tk, ok := t.tokens[key]
+	t.mu.Unlock()
+	if ok && tk.valid() && !refresh {
+		return tk.value, nil
+	}
+
+	tk, err := t.fetchToken(req, c, scopes)
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	t.tokens[key] = tk
+	t.mu.Unlock()
+	return tk.value, nil
+}
+
+func (t *authTransport) fetchToken(req *http.Request, c *challenge, scopes []string) (token, error) {
+	realm, err := url.Parse(c.params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return token{}, fmt.Errorf("invalid token realm %q", c.params["realm"])
+	}
+
+	tokenReq, err := t.tokenRequest(req, realm, c.params["service"], scopes)
+	if err != nil {
+		return token{}, err
+	}
+	debugf(t.debug, "fetching token from %s", realm.String())
+	resp, err := t.base.RoundTrip(tokenReq)
+	if err != nil {
+		return token{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return token{}, newError(resp, "fetch token from "+realm.Host, "", "")
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return token{}, err
+	}
+	return parseToken(data)
+}
+
+func (t *authTransport) tokenRequest(req *http.Request, realm *url.URL, service string, scopes []string) (*http.Request, error) {
+	if t.credential.IdentityToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", t.credential.IdentityToken)
+		form.Set("client_id", "isync")
+		form.Set("service", service)
+		form.Set("scope", strings.Join(scopes, " "))
+		tokenReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, realm.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return tokenReq, nil
+	}
+
+	query := realm.Query()
+	if service != "" {
+		query.Set("service", service)
+	}
+	for _, scope := range scopes {
+		query.Add("scope", scope)
+	}
+	if t.credential.Username != "" {
+		query.Set("account", t.credential.Username)
+	}
+	realm.RawQuery = query.Encode()
+
+	tokenReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.credential.Username != "" || t.credential.Password != "" {
+		tokenReq.Header.Set("Authorization", "Basic "+basicAuth(t.credential))
+	}
+	return tokenReq, nil
+}
+
+func parseToken(data []byte) (token, error) {
+	var body struct {
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int       `json:"expires_in"`
+		IssuedAt    time.Time `json:"issued_at"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return token{}, fmt.Errorf("failed to decode token response: %v", err)
+	}
+
+	tk := token{value: body.Token}
+	if tk.value == "" {
+		tk.value = body.AccessToken
+	}
+	if tk.value == "" {
+		return token{}, fmt.Errorf("token response does not contain a token")
+	}
+
+	expiry := defaultTokenExpiry
+	if body.ExpiresIn > 0 {
+		expiry = time.Duration(body.ExpiresIn) * time.Second
+	}
+	issuedAt := body.IssuedAt
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+	// refresh a little before the registry starts rejecting the token
+	if expiry > 2*tokenExpiryMargin {
+		expiry -= tokenExpiryMargin
+	}
+	tk.expiresAt = issuedAt.Add(expiry)
+	return tk, nil
+}
+
+// scopesFor derives the token scopes a request needs from its path, e.g.
+// /v2/<repo>/blobs/uploads/ needs repository:<repo>:pull,push.
+func scopesFor(req *http.Request) []string {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == req.URL.Path || path == "" {
+		return nil
+	}
+	if path == "_catalog" {
+		return []string{"registry:catalog:*"}
+	}
+
+	repo := ""
+	for _, sep := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		if i := strings.Index(path, sep); i > 0 {
+			repo = path[:i]
+			break
+		}
+	}
+	if repo == "" {
+		return nil
+	}
+
+	actions := "pull"
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		actions = "pull,push"
+	}
+	scopes := []string{fmt.Sprintf("repository:%s:%s", repo, actions)}
+	if from := req.URL.Query().Get("from"); from != "" && from != repo {
+		scopes = append(scopes, fmt.Sprintf("repository:%s:pull", from))
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func basicAuth(c Credential) string {
+	return base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+}
+
+// parseChallenge picks the bearer challenge out of the WWW-Authenticate
+// headers, falling back to basic.
+func parseChallenge(headers []string) (*challenge, bool) {
+	var basic *challenge
+	for _, header := range headers {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+		c := &challenge{scheme: strings.ToLower(scheme), params: parseParams(rest)}
+		switch c.scheme {
+		case "bearer":
+			return c, true
+		case "basic":
+			basic = c
+		}
+	}
+	return basic, basic != nil
+}
+
+func parseParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return params
+		}
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value, s = b.String(), rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+}
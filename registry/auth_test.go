@@ -0,0 +1,247 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenServer issues a new token per request, valid for the scope asked for,
+// and records the scopes it was asked for.
+type tokenServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	issued map[string]string // token -> scope
+	scopes []string
+	// issuedAt backdates the tokens, to make them expire right away
+	issuedAt time.Time
+}
+
+func newTokenServer(t *testing.T) *tokenServer {
+	ts := &tokenServer{issued: make(map[string]string)}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("service") != "registry.test" || r.URL.Query().Get("account") != "alice" {
+			t.Errorf("token request %s lacks service or account", r.URL)
+		}
+		scope := strings.Join(r.URL.Query()["scope"], " ")
+
+		ts.mu.Lock()
+		tk := fmt.Sprintf("token-%d", len(ts.scopes)+1)
+		ts.issued[tk] = scope
+		ts.scopes = append(ts.scopes, scope)
+		issuedAt := ts.issuedAt
+		ts.mu.Unlock()
+
+		body := map[string]any{"token": tk, "expires_in": 60}
+		if !issuedAt.IsZero() {
+			body["issued_at"] = issuedAt
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *tokenServer) requested() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]string{}, ts.scopes...)
+}
+
+// bearerRegistry serves the tags of any repository to requests bearing a
+// token issued for the pull scope of the repository.
+func bearerRegistry(t *testing.T, ts *tokenServer) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), "/tags/list")
+		scope := "repository:" + repo + ":pull"
+		tk := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		ts.mu.Lock()
+		valid := ts.issued[tk] == scope
+		ts.mu.Unlock()
+		if !valid {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.test",scope="%s"`, ts.URL, scope))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"name": repo, "tags": []string{"latest"}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBearerTokenFlow(t *testing.T) {
+	ts := newTokenServer(t)
+	srv := bearerRegistry(t, ts)
+	r := NewRegistry(srv.URL, WithCredential("alice", "secret"))
+	ctx := context.Background()
+
+	for _, repo := range []string{"library/nginx", "library/nginx", "library/redis", "library/nginx"} {
+		tags, err := r.Tags(ctx, repo)
+		if err != nil {
+			t.Fatalf("Tags(%s): %v", repo, err)
+		}
+		if !reflect.DeepEqual(tags, []string{"latest"}) {
+			t.Fatalf("Tags(%s) = %v", repo, tags)
+		}
+	}
+
+	// a token per scope, reused for later requests of the same scope
+	want := []string{"repository:library/nginx:pull", "repository:library/redis:pull"}
+	if got := ts.requested(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requested scopes %v, want %v", got, want)
+	}
+}
+
+func TestBearerTokenRefresh(t *testing.T) {
+	ts := newTokenServer(t)
+	srv := bearerRegistry(t, ts)
+	r := NewRegistry(srv.URL, WithCredential("alice", "secret"))
+	ctx := context.Background()
+
+	// tokens issued long ago are expired by the time they are cached
+	ts.mu.Lock()
+	ts.issuedAt = time.Now().Add(-time.Hour)
+	ts.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if _, err := r.Tags(ctx, "library/nginx"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(ts.requested()); got != 2 {
+		t.Errorf("expired token refreshed %d times, want 2 fetches", got)
+	}
+
+	// a token the registry stops accepting is refreshed on the challenge
+	ts.mu.Lock()
+	ts.issuedAt = time.Time{}
+	ts.issued = make(map[string]string)
+	ts.mu.Unlock()
+	if _, err := r.Tags(ctx, "library/nginx"); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(ts.requested()); got != 3 {
+		t.Errorf("rejected token refreshed with %d fetches, want 3", got)
+	}
+}
+
+func TestBearerTokenDenied(t *testing.T) {
+	ts := newTokenServer(t)
+	srv := bearerRegistry(t, ts)
+	r := NewRegistry(srv.URL, WithCredential("alice", "wrong"))
+
+	_, err := r.Tags(context.Background(), "library/nginx")
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Tags with a wrong password: %v, want a 401 of the token server", err)
+	}
+}
+
+func TestBasicAuthFallback(t *testing.T) {
+	var requests, authorized int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			w.Header().Add("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		authorized++
+		json.NewEncoder(w).Encode(map[string]any{"tags": []string{"1.0"}})
+	}))
+	defer srv.Close()
+	r := NewRegistry(srv.URL, WithCredential("alice", "secret"))
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Tags(context.Background(), "library/nginx"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the challenge is answered once, later requests carry basic auth upfront
+	if requests != 3 || authorized != 2 {
+		t.Errorf("%d requests, %d authorized, want 3 and 2", requests, authorized)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		headers []string
+		scheme  string
+		ok      bool
+	}{
+		{[]string{`Bearer realm="https://auth.test/token"`}, "bearer", true},
+		{[]string{`Basic realm="registry"`}, "basic", true},
+		{[]string{`Basic realm="registry"`, `Bearer realm="https://auth.test/token"`}, "bearer", true},
+		{[]string{`Negotiate`}, "", false},
+		{nil, "", false},
+	}
+	for _, tt := range tests {
+		c, ok := parseChallenge(tt.headers)
+		if ok != tt.ok || ok && c.scheme != tt.scheme {
+			t.Errorf("parseChallenge(%q) = %v, %v, want %s, %v", tt.headers, c, ok, tt.scheme, tt.ok)
+		}
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{``, map[string]string{}},
+		{`realm="https://auth.test/token"`, map[string]string{"realm": "https://auth.test/token"}},
+		{
+			`realm="https://auth.test/token",service="registry.test",scope="repository:a/b:pull,push"`,
+			map[string]string{"realm": "https://auth.test/token", "service": "registry.test", "scope": "repository:a/b:pull,push"},
+		},
+		{`Realm="r", Service="s"`, map[string]string{"realm": "r", "service": "s"}},
+		{`realm=r,service=s`, map[string]string{"realm": "r", "service": "s"}},
+		{`realm="say \"hi\""`, map[string]string{"realm": `say "hi"`}},
+		{`realm="unterminated`, map[string]string{"realm": "unterminated"}},
+		{`realm="r",error="insufficient_scope"`, map[string]string{"realm": "r", "error": "insufficient_scope"}},
+		{`novalue`, map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := parseParams(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseParams(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestScopesFor(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   []string
+	}{
+		{http.MethodGet, "/v2/", nil},
+		{http.MethodGet, "/v2/_catalog", []string{"registry:catalog:*"}},
+		{http.MethodGet, "/v2/library/nginx/manifests/1.25", []string{"repository:library/nginx:pull"}},
+		{http.MethodHead, "/v2/library/nginx/blobs/sha256:abc", []string{"repository:library/nginx:pull"}},
+		{http.MethodGet, "/v2/library/nginx/tags/list", []string{"repository:library/nginx:pull"}},
+		{http.MethodPut, "/v2/mirror/nginx/manifests/1.25", []string{"repository:mirror/nginx:pull,push"}},
+		{
+			http.MethodPost, "/v2/mirror/nginx/blobs/uploads/?mount=sha256:abc&from=library/nginx",
+			[]string{"repository:library/nginx:pull", "repository:mirror/nginx:pull,push"},
+		},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := scopesFor(req); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scopesFor(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
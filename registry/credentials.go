@@ -0,0 +1,219 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dockerHubConfigKey = "https://index.docker.io/v1/"
+	// credential helpers answer "get" with this message when they hold nothing for a host
+	helperNotFound = "credentials not found in native keychain"
+)
+
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+type credentialsFile struct {
+	Registries map[string]dockerAuth `json:"registries"`
+}
+
+// ResolveCredential looks up the credential of a registry host. Sources are
+// consulted in this order, the first one holding the host wins:
+//
+//  1. the isync credentials file (credsFile, $ISYNC_CREDENTIALS or ~/.isync/credentials.json)
+//  2. the credHelpers entry of the host in docker's config.json
+//  3. the credsStore of docker's config.json
+//  4. the auths entry of the host in docker's config.json
+//
+// An empty credential is returned when no source knows the host.
+func ResolveCredential(host string, credsFile string) (Credential, error) {
+	if credsFile == "" {
+		credsFile = os.Getenv("ISYNC_CREDENTIALS")
+	}
+	if credsFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			credsFile = filepath.Join(home, ".isync", "credentials.json")
+		}
+	}
+	if c, ok, err := fromCredentialsFile(credsFile, host); err != nil || ok {
+		return c, err
+	}
+
+	config, err := loadDockerConfig()
+	if err != nil || config == nil {
+		return Credential{}, err
+	}
+	for key, helper := range config.CredHelpers {
+		if configHost(key) == host {
+			return fromHelper(helper, key)
+		}
+	}
+	key, auth, found := config.lookup(host)
+	if config.CredsStore != "" {
+		if !found {
+			key = host
+			if isDockerHub(host) {
+				key = dockerHubConfigKey
+			}
+		}
+		if c, err := fromHelper(config.CredsStore, key); err != nil || !c.empty() {
+			return c, err
+		}
+	}
+	if !found {
+		return Credential{}, nil
+	}
+	return auth.credential()
+}
+
+func fromCredentialsFile(path string, host string) (Credential, bool, error) {
+	if path == "" {
+		return Credential{}, false, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Credential{}, false, nil
+	}
+	if err != nil {
+		return Credential{}, false, err
+	}
+
+	file := credentialsFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return Credential{}, false, fmt.Errorf("failed to parse credentials file %s: %v", path, err)
+	}
+	for key, auth := range file.Registries {
+		if configHost(key) == host {
+			c, err := auth.credential()
+			return c, err == nil, err
+		}
+	}
+	return Credential{}, false, nil
+}
+
+func loadDockerConfig() (*dockerConfig, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+
+	path := filepath.Join(dir, "config.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := &dockerConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse docker config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+func (c *dockerConfig) lookup(host string) (string, dockerAuth, bool) {
+	for key, auth := range c.Auths {
+		if configHost(key) == host {
+			return key, auth, true
+		}
+	}
+	return "", dockerAuth{}, false
+}
+
+func (a dockerAuth) credential() (Credential, error) {
+	c := Credential{
+		Username:      a.Username,
+		Password:      a.Password,
+		IdentityToken: a.IdentityToken,
+	}
+	if a.Auth == "" {
+		return c, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+	if err != nil {
+		return Credential{}, fmt.Errorf("failed to decode auth: %v", err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return Credential{}, errors.New("invalid auth, expected username:password")
+	}
+	c.Username, c.Password = username, password
+	return c, nil
+}
+
+// fromHelper runs docker-credential-<helper> get, see
+// https://github.com/docker/docker-credential-helpers for the protocol.
+func fromHelper(helper string, serverURL string) (Credential, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String()+stderr.String(), helperNotFound) {
+			return Credential{}, nil
+		}
+		return Credential{}, fmt.Errorf("credential helper %s failed for %s: %v: %s", helper, serverURL, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var out struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return Credential{}, fmt.Errorf("failed to decode output of credential helper %s: %v", helper, err)
+	}
+	// helpers store identity tokens with this placeholder username
+	if out.Username == "<token>" {
+		return Credential{IdentityToken: out.Secret}, nil
+	}
+	return Credential{Username: out.Username, Password: out.Secret}, nil
+}
+
+// configHost reduces a config key such as https://index.docker.io/v1/ to the
+// registry host requests are sent to.
+func configHost(key string) string {
+	host := key
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host, _, _ = strings.Cut(host, "/")
+	if isDockerHub(host) {
+		return "registry-1.docker.io"
+	}
+	return host
+}
+
+func isDockerHub(host string) bool {
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package registry
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeHelper answers get like a docker-credential-* helper, logging the
+// server URLs it was asked for to the file named by $FAKE_HELPER_LOG.
+const fakeHelper = `#!/bin/sh
+[ "$1" = get ] || exit 2
+read -r server
+echo "$server" >> "$FAKE_HELPER_LOG"
+case "$server" in
+helper.test) echo '{"ServerURL":"helper.test","Username":"helper","Secret":"helper-secret"}' ;;
+store.test) echo '{"ServerURL":"store.test","Username":"store","Secret":"store-secret"}' ;;
+https://index.docker.io/v1/) echo '{"Username":"hub","Secret":"hub-secret"}' ;;
+token.test) echo '{"Username":"<token>","Secret":"identity"}' ;;
+broken.test) echo 'keychain locked' >&2; exit 1 ;;
+*) echo 'credentials not found in native keychain'; exit 1 ;;
+esac
+`
+
+// credentialEnv sets up a docker config, an isync credentials file and the
+// fake credential helper on PATH, and returns the helper log.
+func credentialEnv(t *testing.T) (credsFile string, helperLog string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake credential helper is a shell script")
+	}
+	dir := t.TempDir()
+	auth := func(userpass string) string {
+		return base64.StdEncoding.EncodeToString([]byte(userpass))
+	}
+	write := func(name string, content string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	write("config.json", `{
+  "auths": {
+    "file.test": {"auth": "`+auth("file-auths:x")+`"},
+    "helper.test": {"auth": "`+auth("helper-auths:x")+`"},
+    "store.test": {"auth": "`+auth("store-auths:x")+`"},
+    "auths.test": {"username": "auths", "password": "auths-secret"},
+    "https://auths-url.test/v2/": {"auth": "`+auth("url:url-secret")+`"},
+    "identity.test": {"identitytoken": "identity-auths"},
+    "invalid.test": {"auth": "`+auth("no-colon")+`"}
+  },
+  "credHelpers": {"helper.test": "fake", "broken.test": "fake"},
+  "credsStore": "fake"
+}`, 0o600)
+	write("docker-credential-fake", fakeHelper, 0o755)
+	credsFile = write("credentials.json", `{"registries": {"https://file.test": {"username": "isync", "password": "isync-secret"}}}`, 0o600)
+	helperLog = filepath.Join(dir, "helper.log")
+
+	t.Setenv("DOCKER_CONFIG", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("ISYNC_CREDENTIALS", "")
+	t.Setenv("FAKE_HELPER_LOG", helperLog)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return credsFile, helperLog
+}
+
+func TestResolveCredential(t *testing.T) {
+	credsFile, helperLog := credentialEnv(t)
+	tests := []struct {
+		host string
+		want Credential
+		// asked is the server URL the helper is asked for, if any
+		asked   string
+		wantErr bool
+	}{
+		{host: "file.test", want: Credential{Username: "isync", Password: "isync-secret"}},
+		{host: "helper.test", want: Credential{Username: "helper", Password: "helper-secret"}, asked: "helper.test"},
+		{host: "store.test", want: Credential{Username: "store", Password: "store-secret"}, asked: "store.test"},
+		{host: "auths.test", want: Credential{Username: "auths", Password: "auths-secret"}, asked: "auths.test"},
+		{host: "auths-url.test", want: Credential{Username: "url", Password: "url-secret"}, asked: "https://auths-url.test/v2/"},
+		{host: "registry-1.docker.io", want: Credential{Username: "hub", Password: "hub-secret"}, asked: "https://index.docker.io/v1/"},
+		{host: "token.test", want: Credential{IdentityToken: "identity"}, asked: "token.test"},
+		{host: "identity.test", want: Credential{IdentityToken: "identity-auths"}, asked: "identity.test"},
+		{host: "unknown.test", want: Credential{}, asked: "unknown.test"},
+		{host: "broken.test", asked: "broken.test", wantErr: true},
+		{host: "invalid.test", asked: "invalid.test", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			os.Remove(helperLog)
+			got, err := ResolveCredential(tt.host, credsFile)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ResolveCredential(%s) = %+v, %v, want %+v, error %v", tt.host, got, err, tt.want, tt.wantErr)
+			}
+			log, _ := os.ReadFile(helperLog)
+			if asked := strings.TrimSpace(string(log)); asked != tt.asked {
+				t.Errorf("helper asked for %q, want %q", asked, tt.asked)
+			}
+		})
+	}
+}
+
+func TestResolveCredentialFileFromEnv(t *testing.T) {
+	credsFile, _ := credentialEnv(t)
+	t.Setenv("ISYNC_CREDENTIALS", credsFile)
+	got, err := ResolveCredential("file.test", "")
+	if want := (Credential{Username: "isync", Password: "isync-secret"}); err != nil || got != want {
+		t.Errorf("ResolveCredential(file.test) = %+v, %v, want %+v", got, err, want)
+	}
+
+	t.Setenv("ISYNC_CREDENTIALS", filepath.Join(t.TempDir(), "missing.json"))
+	got, err = ResolveCredential("file.test", "")
+	if want := (Credential{Username: "file-auths", Password: "x"}); err != nil || got != want {
+		t.Errorf("ResolveCredential(file.test) without the file = %+v, %v, want %+v", got, err, want)
+	}
+}
+
+func TestConfigHost(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"https://index.docker.io/v1/", "registry-1.docker.io"},
+		{"docker.io", "registry-1.docker.io"},
+		{"index.docker.io", "registry-1.docker.io"},
+		{"registry.example.com", "registry.example.com"},
+		{"https://registry.example.com/v2/", "registry.example.com"},
+		{"http://localhost:5000", "localhost:5000"},
+	}
+	for _, tt := range tests {
+		if got := configHost(tt.key); got != tt.want {
+			t.Errorf("configHost(%s) = %s, want %s", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// maxDownloadResumes is how many times in a row a download is resumed
+// without receiving any data before it is given up.
+const maxDownloadResumes = 3
+
+// LayerDownload streams a blob. A connection that breaks mid-stream is resumed
+// with a Range request from the last byte received, and the stream fails at
+// its end instead of returning io.EOF when the content does not match digest.
+func (r *DockerRegistry) LayerDownload(ctx context.Context, repo string, digest digest.Digest) (io.ReadCloser, error) {
+	if err := digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid layer digest %q: %v", digest, err)
+	}
+	url := r.urlf("/v2/%s/blobs/%s", repo, digest)
+	debugf(r.debug, "downloading layer from %s", url)
+	b := &blobReader{
+		ctx:      ctx,
+		client:   r.Client,
+		repo:     repo,
+		url:      url,
+		digest:   digest,
+		size:     -1,
+		digester: digest.Algorithm().Digester(),
+	}
+	if err := b.open(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+type blobReader struct {
+	ctx    context.Context
+	client *http.Client
+	repo   string
+	url    string
+	// redirected is the blob storage URL the registry redirected to, Range
+	// requests go there directly while it is still valid
+	redirected string
+	digest     digest.Digest
+	digester   digest.Digester
+
+	body    io.ReadCloser
+	offset  int64
+	size    int64
+	resumes int
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.digester.Hash().Write(p[:n])
+		b.offset += int64(n)
+		b.resumes = 0
+	}
+
+	switch {
+	case err == nil:
+		return n, nil
+	case errors.Is(err, io.EOF) && (b.size < 0 || b.offset >= b.size):
+		if got := b.digester.Digest(); got != b.digest {
+			return n, fmt.Errorf("layer %s does not match its digest, got %s after %d bytes", b.digest, got, b.offset)
+		}
+		return n, io.EOF
+	case b.ctx.Err() != nil || b.resumes == maxDownloadResumes:
+		return n, err
+	}
+
+	log.Printf("registry: download of layer %s broken at %d bytes, resuming: %v", b.digest, b.offset, err)
+	b.body.Close()
+	for b.resumes < maxDownloadResumes {
+		b.resumes++
+		if err = b.open(); err == nil {
+			return n, nil
+		}
+	}
+	return n, err
+}
+
+func (b *blobReader) Close() error {
+	return b.body.Close()
+}
+
+// open requests the blob from the current offset, through the redirected URL
+// first and the registry again when that is rejected, e.g. because a
+// pre-signed URL expired.
+func (b *blobReader) open() error {
+	if b.redirected != "" {
+		err := b.request(b.redirected)
+		if err == nil {
+			return nil
+		}
+		log.Printf("registry: resuming layer %s from %s failed, falling back to registry: %v", b.digest, b.redirected, err)
+		b.redirected = ""
+	}
+	return b.request(b.url)
+}
+
+func (b *blobReader) request(url string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if b.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+	}
+	resp, err := ctxhttp.Do(b.ctx, b.client, req)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && b.offset > 0:
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the Range header, skip what has been read already
+		if _, err := io.CopyN(io.Discard, resp.Body, b.offset); err != nil {
+			resp.Body.Close()
+			return err
+		}
+		if resp.ContentLength >= 0 {
+			b.size = resp.ContentLength
+		}
+	default:
+		err := newError(resp, "download layer", b.repo, b.digest.String())
+		resp.Body.Close()
+		return err
+	}
+
+	if resp.Request.URL.String() != url {
+		b.redirected = resp.Request.URL.String()
+	}
+	b.body = resp.Body
+	return nil
+}
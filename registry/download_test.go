@@ -0,0 +1,216 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// blobServer serves content, breaking the connection of the first breaks
+// responses halfway. Range requests are answered with 206 unless ignoreRange
+// is set. With expire set it serves a pre-signed URL, given by its sig query,
+// once and rejects it afterwards.
+type blobServer struct {
+	*httptest.Server
+	content     []byte
+	breaks      int
+	ignoreRange bool
+	expire      bool
+
+	mu     sync.Mutex
+	ranges []string
+	// authorized counts the requests carrying an Authorization header
+	authorized int
+	signatures map[string]bool
+}
+
+func newBlobServer(t *testing.T, content []byte, breaks int, ignoreRange bool) *blobServer {
+	s := &blobServer{content: content, breaks: breaks, ignoreRange: ignoreRange}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *blobServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	if r.Header.Get("Authorization") != "" {
+		s.authorized++
+	}
+	expired := s.expire && s.signatures[r.URL.Query().Get("sig")]
+	if s.signatures == nil {
+		s.signatures = make(map[string]bool)
+	}
+	s.signatures[r.URL.Query().Get("sig")] = true
+	broken := s.breaks > 0 && !expired
+	if !expired {
+		s.breaks--
+	}
+	s.mu.Unlock()
+
+	if expired {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Request has expired</Message></Error>`)
+		return
+	}
+
+	content, status := s.content, http.StatusOK
+	if offset, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok && !s.ignoreRange {
+		start, _ := strconv.Atoi(strings.TrimSuffix(offset, "-"))
+		content, status = content[start:], http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(s.content)-1, len(s.content)))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	if !broken {
+		w.WriteHeader(status)
+		w.Write(content)
+		return
+	}
+
+	// send half of the content, then drop the connection
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\nContent-Length: %d\r\n\r\n", status, http.StatusText(status), len(content))
+	buf.Write(content[:len(content)/2])
+	buf.Flush()
+}
+
+func TestLayerDownload(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	tests := []struct {
+		name        string
+		breaks      int
+		ignoreRange bool
+		digest      digest.Digest
+		ranges      []string
+		err         bool
+	}{
+		{name: "whole", ranges: []string{""}},
+		{name: "resumed", breaks: 1, ranges: []string{"", "bytes=500-"}},
+		{name: "resumed twice", breaks: 2, ranges: []string{"", "bytes=500-", "bytes=750-"}},
+		{name: "range ignored", breaks: 1, ignoreRange: true, ranges: []string{"", "bytes=500-"}},
+		{name: "digest mismatch", digest: digest.FromString("other"), ranges: []string{""}, err: true},
+		// every resume that receives data counts as a new start
+		{name: "resumed as long as it progresses", breaks: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newBlobServer(t, content, tt.breaks, tt.ignoreRange)
+			dgst := tt.digest
+			if dgst == "" {
+				dgst = digest.FromBytes(content)
+			}
+			r := NewRegistry(srv.URL, WithCredential("test", "test"), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+
+			reader, err := r.LayerDownload(context.Background(), "library/app", dgst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(reader)
+			reader.Close()
+			if tt.err {
+				if err == nil {
+					t.Fatal("download succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(content) {
+				t.Errorf("downloaded %d bytes differing from the content", len(got))
+			}
+			if tt.ranges != nil && fmt.Sprint(srv.ranges) != fmt.Sprint(tt.ranges) {
+				t.Errorf("requested ranges %q, want %q", srv.ranges, tt.ranges)
+			}
+		})
+	}
+}
+
+// newRedirectingRegistry returns a registry that requires basic auth and
+// serves blobs by redirecting to a new pre-signed URL of storage on every
+// request, recording the ranges requested from it into ranges.
+func newRedirectingRegistry(t *testing.T, storage *blobServer, ranges *[]string) *httptest.Server {
+	var mu sync.Mutex
+	var signed int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		*ranges = append(*ranges, r.Header.Get("Range"))
+		signed++
+		sig := signed
+		mu.Unlock()
+		http.Redirect(w, r, fmt.Sprintf("%s/blobs/content?sig=%d", storage.URL, sig), http.StatusTemporaryRedirect)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLayerDownloadRedirected(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	tests := []struct {
+		name   string
+		breaks int
+		expire bool
+		// ranges are the ranges requested from the registry and the storage
+		registryRanges []string
+		storageRanges  []string
+	}{
+		{name: "whole", registryRanges: []string{""}, storageRanges: []string{""}},
+		{name: "resumed from storage", breaks: 1, registryRanges: []string{""}, storageRanges: []string{"", "bytes=500-"}},
+		{name: "resumed twice from storage", breaks: 2, registryRanges: []string{""}, storageRanges: []string{"", "bytes=500-", "bytes=750-"}},
+		{
+			name:           "expired url",
+			breaks:         1,
+			expire:         true,
+			registryRanges: []string{"", "bytes=500-"},
+			storageRanges:  []string{"", "bytes=500-", "bytes=500-"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newBlobServer(t, content, tt.breaks, false)
+			storage.expire = tt.expire
+			var registryRanges []string
+			srv := newRedirectingRegistry(t, storage, &registryRanges)
+			r := NewRegistry(srv.URL, WithCredential("test", "test"), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+
+			reader, err := r.LayerDownload(context.Background(), "library/app", digest.FromBytes(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(content) {
+				t.Errorf("downloaded %d bytes differing from the content", len(got))
+			}
+			if fmt.Sprint(registryRanges) != fmt.Sprint(tt.registryRanges) {
+				t.Errorf("requested ranges %q from the registry, want %q", registryRanges, tt.registryRanges)
+			}
+			if fmt.Sprint(storage.ranges) != fmt.Sprint(tt.storageRanges) {
+				t.Errorf("requested ranges %q from the storage, want %q", storage.ranges, tt.storageRanges)
+			}
+			if storage.authorized > 0 {
+				t.Errorf("%d requests to the storage carried the credential of the registry", storage.authorized)
+			}
+		})
+	}
+}
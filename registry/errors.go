@@ -0,0 +1,137 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrorCode is a code of the error envelope of the distribution spec. Codes
+// are errors themselves so that callers can match them with errors.Is:
+//
+//	if errors.Is(err, registry.ErrorCodeManifestUnknown) { ... }
+type ErrorCode string
+
+const (
+	ErrorCodeBlobUnknown         ErrorCode = "BLOB_UNKNOWN"
+	ErrorCodeBlobUploadInvalid   ErrorCode = "BLOB_UPLOAD_INVALID"
+	ErrorCodeBlobUploadUnknown   ErrorCode = "BLOB_UPLOAD_UNKNOWN"
+	ErrorCodeDigestInvalid       ErrorCode = "DIGEST_INVALID"
+	ErrorCodeManifestBlobUnknown ErrorCode = "MANIFEST_BLOB_UNKNOWN"
+	ErrorCodeManifestInvalid     ErrorCode = "MANIFEST_INVALID"
+	ErrorCodeManifestUnknown     ErrorCode = "MANIFEST_UNKNOWN"
+	ErrorCodeNameInvalid         ErrorCode = "NAME_INVALID"
+	ErrorCodeNameUnknown         ErrorCode = "NAME_UNKNOWN"
+	ErrorCodeSizeInvalid         ErrorCode = "SIZE_INVALID"
+	ErrorCodeUnauthorized        ErrorCode = "UNAUTHORIZED"
+	ErrorCodeDenied              ErrorCode = "DENIED"
+	ErrorCodeUnsupported         ErrorCode = "UNSUPPORTED"
+	ErrorCodeTooManyRequests     ErrorCode = "TOOMANYREQUESTS"
+)
+
+func (c ErrorCode) Error() string {
+	return strings.ToLower(strings.ReplaceAll(string(c), "_", " "))
+}
+
+// ErrorDetail is an entry of the errors envelope,
+// {"errors":[{"code":"MANIFEST_UNKNOWN","message":"...","detail":...}]}.
+type ErrorDetail struct {
+	Code    ErrorCode       `json:"code"`
+	Message string          `json:"message"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+// Error is a request the registry answered with an unexpected status code.
+type Error struct {
+	// Op describes the failed call, e.g. "fetch manifest"
+	Op         string
+	StatusCode int
+	Repository string
+	// Reference is the tag or digest of the manifest or blob, if any
+	Reference string
+	Errors    []ErrorDetail
+	// Body is the response body when it is not an errors envelope
+	Body string
+	// RetryAfter is how long the registry asked to wait before trying again
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "failed to %s", e.Op)
+	switch {
+	case e.Repository != "" && e.Reference != "":
+		fmt.Fprintf(&b, " %s:%s", e.Repository, e.Reference)
+	case e.Repository != "":
+		fmt.Fprintf(&b, " %s", e.Repository)
+	}
+	fmt.Fprintf(&b, ", status code: %d", e.StatusCode)
+	for _, detail := range e.Errors {
+		fmt.Fprintf(&b, ", %s: %s", detail.Code, detail.Message)
+	}
+	if len(e.Errors) == 0 && e.Body != "" {
+		fmt.Fprintf(&b, ", error message: %s", e.Body)
+	}
+	return b.String()
+}
+
+// Code returns the first code of the errors envelope, or the code implied by
+// the status code when the registry did not send one, e.g. on HEAD requests.
+func (e *Error) Code() ErrorCode {
+	if len(e.Errors) > 0 {
+		return e.Errors[0].Code
+	}
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrorCodeDenied
+	case http.StatusTooManyRequests:
+		return ErrorCodeTooManyRequests
+	}
+	return ""
+}
+
+// Is matches an ErrorCode against every code of the errors envelope.
+func (e *Error) Is(target error) bool {
+	code, ok := target.(ErrorCode)
+	if !ok {
+		return false
+	}
+	for _, detail := range e.Errors {
+		if detail.Code == code {
+			return true
+		}
+	}
+	return e.Code() == code
+}
+
+// newError builds an Error out of a response, consuming its body.
+func newError(resp *http.Response, op string, repo string, ref string) *Error {
+	e := &Error{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Repository: repo,
+		Reference:  ref,
+	}
+	if after, ok := retryAfter(resp); ok {
+		e.RetryAfter = after
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return e.withBody(data)
+}
+
+func (e *Error) withBody(data []byte) *Error {
+	var envelope struct {
+		Errors []ErrorDetail `json:"errors"`
+	}
+	if err := json.Unmarshal(data, &envelope); err == nil && len(envelope.Errors) > 0 {
+		e.Errors = envelope.Errors
+	} else {
+		e.Body = strings.TrimSpace(string(data))
+	}
+	return e
+}
@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewError(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		code    ErrorCode
+		matches []ErrorCode
+		message string
+	}{
+		{
+			http.StatusNotFound,
+			`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":{"Tag":"1.25"}}]}`,
+			ErrorCodeManifestUnknown, []ErrorCode{ErrorCodeManifestUnknown},
+			"failed to fetch manifest library/nginx:1.25, status code: 404, manifest unknown: manifest unknown",
+		},
+		{
+			http.StatusBadRequest,
+			`{"errors":[{"code":"MANIFEST_INVALID","message":"manifest invalid"},{"code":"MANIFEST_BLOB_UNKNOWN","message":"blob unknown to registry"}]}`,
+			ErrorCodeManifestInvalid, []ErrorCode{ErrorCodeManifestInvalid, ErrorCodeManifestBlobUnknown},
+			"failed to fetch manifest library/nginx:1.25, status code: 400, manifest invalid: manifest invalid, manifest blob unknown: blob unknown to registry",
+		},
+		{
+			http.StatusTooManyRequests, "",
+			ErrorCodeTooManyRequests, []ErrorCode{ErrorCodeTooManyRequests},
+			"failed to fetch manifest library/nginx:1.25, status code: 429",
+		},
+		{
+			http.StatusBadGateway, "<html>bad gateway</html>\n",
+			"", nil,
+			"failed to fetch manifest library/nginx:1.25, status code: 502, error message: <html>bad gateway</html>",
+		},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Body: io.NopCloser(strings.NewReader(tt.body))}
+		err := fmt.Errorf("sync: %w", newError(resp, "fetch manifest", "library/nginx", "1.25"))
+
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Fatalf("%v is no *Error", err)
+		}
+		if e.Code() != tt.code {
+			t.Errorf("Code() = %q, want %q", e.Code(), tt.code)
+		}
+		for _, code := range tt.matches {
+			if !errors.Is(err, code) {
+				t.Errorf("%v does not match %s", err, code)
+			}
+		}
+		if errors.Is(err, ErrorCodeBlobUnknown) {
+			t.Errorf("%v matches %s", err, ErrorCodeBlobUnknown)
+		}
+		if e.Error() != tt.message {
+			t.Errorf("Error() = %q, want %q", e.Error(), tt.message)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAdaptiveLimit caps adaptive limits that are not configured
+	defaultAdaptiveLimit = 32
+	// latencyWeight is the weight of a request in the average latency
+	latencyWeight = 0.2
+)
+
+// Limits bound the concurrent requests to a registry per kind of request,
+// zero does not limit them.
+type Limits struct {
+	Manifests int
+	// BlobHeads are the requests checking whether blobs exist
+	BlobHeads int
+	// BlobTransfers are the requests downloading, uploading and mounting
+	// blobs, including the requests to the storage the registry redirects to
+	BlobTransfers int
+	// Adaptive halves a limit when the registry answers 429 or 503, and
+	// raises it by one again after as many requests as the limit that took no
+	// longer than twice the average latency, up to the configured limit.
+	Adaptive bool
+}
+
+// ParseLimits parses limits given as comma separated key=value pairs, e.g.
+// "manifests=4,heads=16,transfers=2,adaptive".
+func ParseLimits(s string) (Limits, error) {
+	limits := Limits{}
+	for _, field := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if key == "adaptive" && !ok {
+			limits.Adaptive = true
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil || n < 0 {
+			return Limits{}, fmt.Errorf("invalid limit %q, expected <kind>=<number>", field)
+		}
+		switch key {
+		case "manifests":
+			limits.Manifests = n
+		case "heads":
+			limits.BlobHeads = n
+		case "transfers":
+			limits.BlobTransfers = n
+		default:
+			return Limits{}, fmt.Errorf("invalid limit %q, expected manifests, heads or transfers", field)
+		}
+	}
+	return limits, nil
+}
+
+// limitTransport holds a slot of the limiter of its kind for every request
+// until its response body is closed.
+type limitTransport struct {
+	base      http.RoundTripper
+	host      string
+	manifests *limiter
+	heads     *limiter
+	transfers *limiter
+}
+
+func newLimitTransport(base http.RoundTripper, host string, limits Limits) *limitTransport {
+	return &limitTransport{
+		base:      base,
+		host:      host,
+		manifests: newLimiter(host+" manifests", limits.Manifests, limits.Adaptive),
+		heads:     newLimiter(host+" blob heads", limits.BlobHeads, limits.Adaptive),
+		transfers: newLimiter(host+" blob transfers", limits.BlobTransfers, limits.Adaptive),
+	}
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	l := t.limiterFor(req)
+	if l == nil {
+		return t.base.RoundTrip(req)
+	}
+	if err := l.acquire(req.Context()); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	l.observe(resp.StatusCode, time.Since(start))
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: l.release}
+	return resp, nil
+}
+
+// limiterFor classifies a request by its path. Requests to other hosts are
+// the blob storage a blob request was redirected to, or token requests,
+// which are not limited.
+func (t *limitTransport) limiterFor(req *http.Request) *limiter {
+	for req.URL.Host != t.host {
+		if req.Response == nil {
+			return nil
+		}
+		req = req.Response.Request
+	}
+
+	switch {
+	case strings.Contains(req.URL.Path, "/manifests/"):
+		return t.manifests
+	case strings.Contains(req.URL.Path, "/blobs/") && req.Method == http.MethodHead:
+		return t.heads
+	case strings.Contains(req.URL.Path, "/blobs/"):
+		return t.transfers
+	}
+	return nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// limiter is a semaphore whose size can change while it is held.
+type limiter struct {
+	name     string
+	adaptive bool
+	max      int
+
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiters []chan struct{}
+	// successes counts the healthy requests since the limit last changed
+	successes   int
+	latency     time.Duration
+	lastBackoff time.Time
+}
+
+func newLimiter(name string, limit int, adaptive bool) *limiter {
+	if limit <= 0 && !adaptive {
+		return nil
+	}
+	if limit <= 0 {
+		limit = defaultAdaptiveLimit
+	}
+	return &limiter{
+		name:     name,
+		adaptive: adaptive,
+		max:      limit,
+		limit:    limit,
+	}
+}
+
+func (l *limiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.active < l.limit && len(l.waiters) == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, w := range l.waiters {
+			if w == ready {
+				l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// the slot was handed over while ctx was done, pass it on
+		l.active--
+		l.wake()
+		return ctx.Err()
+	}
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.wake()
+}
+
+// wake hands the free slots over to the waiters, the caller holds l.mu.
+func (l *limiter) wake() {
+	for l.active < l.limit && len(l.waiters) > 0 {
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+		l.active++
+	}
+}
+
+// observe adapts the limit to the response of a request.
+func (l *limiter) observe(status int, latency time.Duration) {
+	if !l.adaptive {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		// the requests in flight when the registry started to push back
+		// answer alike, back off once per round trip
+		if time.Since(l.lastBackoff) < max(l.latency, latency) {
+			return
+		}
+		l.lastBackoff = time.Now()
+		l.successes = 0
+		if l.limit > 1 {
+			l.limit /= 2
+			log.Printf("registry: %s answered %d, lowering concurrency to %d", l.name, status, l.limit)
+		}
+		return
+	}
+	if status >= http.StatusInternalServerError {
+		return
+	}
+
+	healthy := l.latency == 0 || latency <= 2*l.latency
+	if l.latency == 0 {
+		l.latency = latency
+	} else {
+		l.latency += time.Duration(latencyWeight * float64(latency-l.latency))
+	}
+	if !healthy || l.limit >= l.max {
+		return
+	}
+	l.successes++
+	if l.successes >= l.limit {
+		l.successes = 0
+		l.limit++
+		log.Printf("registry: %s is healthy, raising concurrency to %d", l.name, l.limit)
+		l.wake()
+	}
+}
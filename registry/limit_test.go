@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Limits
+		wantErr bool
+	}{
+		{"manifests=4", Limits{Manifests: 4}, false},
+		{"manifests=4,heads=16,transfers=2,adaptive", Limits{Manifests: 4, BlobHeads: 16, BlobTransfers: 2, Adaptive: true}, false},
+		{" heads=8 , transfers=0 ", Limits{BlobHeads: 8}, false},
+		{"adaptive", Limits{Adaptive: true}, false},
+		{"", Limits{}, true},
+		{"manifests", Limits{}, true},
+		{"manifests=four", Limits{}, true},
+		{"transfers=-1", Limits{}, true},
+		{"uploads=2", Limits{}, true},
+		{"adaptive=true", Limits{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimits(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseLimits(%q) = %+v, %v, want %+v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLimiterFor(t *testing.T) {
+	lt := newLimitTransport(http.DefaultTransport, "registry.test", Limits{Manifests: 1, BlobHeads: 1, BlobTransfers: 1})
+	tests := []struct {
+		method string
+		url    string
+		want   *limiter
+	}{
+		{http.MethodGet, "https://registry.test/v2/library/nginx/manifests/1.25", lt.manifests},
+		{http.MethodHead, "https://registry.test/v2/library/nginx/manifests/1.25", lt.manifests},
+		{http.MethodHead, "https://registry.test/v2/library/nginx/blobs/sha256:abc", lt.heads},
+		{http.MethodGet, "https://registry.test/v2/library/nginx/blobs/sha256:abc", lt.transfers},
+		{http.MethodPost, "https://registry.test/v2/library/nginx/blobs/uploads/", lt.transfers},
+		{http.MethodGet, "https://registry.test/v2/library/nginx/tags/list", nil},
+		{http.MethodGet, "https://auth.test/token", nil},
+	}
+	for _, tt := range tests {
+		if got := lt.limiterFor(httptest.NewRequest(tt.method, tt.url, nil)); got != tt.want {
+			t.Errorf("limiterFor(%s %s) = %v, want %v", tt.method, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestLimiterObserve(t *testing.T) {
+	l := newLimiter("test", 8, true)
+	check := func(step string, want int) {
+		t.Helper()
+		if l.limit != want {
+			t.Errorf("%s: limit %d, want %d", step, l.limit, want)
+		}
+	}
+	// a round trip of the registry has passed since the last backoff
+	roundTrip := func() { l.lastBackoff = time.Now().Add(-time.Second) }
+
+	l.observe(http.StatusOK, 10*time.Millisecond)
+	check("healthy at the configured limit", 8)
+	l.observe(http.StatusTooManyRequests, 10*time.Millisecond)
+	check("429", 4)
+	l.observe(http.StatusServiceUnavailable, 10*time.Millisecond)
+	l.observe(http.StatusTooManyRequests, 10*time.Millisecond)
+	check("429 and 503 in the same round trip", 4)
+	roundTrip()
+	l.observe(http.StatusServiceUnavailable, 10*time.Millisecond)
+	check("503 in the next round trip", 2)
+	roundTrip()
+	l.observe(http.StatusTooManyRequests, 10*time.Millisecond)
+	roundTrip()
+	l.observe(http.StatusTooManyRequests, 10*time.Millisecond)
+	check("429 at 1", 1)
+
+	l.observe(http.StatusOK, 10*time.Millisecond)
+	check("as many healthy requests as the limit", 2)
+	l.observe(http.StatusInternalServerError, 10*time.Millisecond)
+	l.observe(http.StatusOK, time.Second)
+	l.observe(http.StatusOK, 10*time.Millisecond)
+	check("a 500, a slow and a healthy request", 2)
+	l.observe(http.StatusOK, 10*time.Millisecond)
+	check("two healthy requests at 2", 3)
+	for i := 0; i < 100; i++ {
+		l.observe(http.StatusOK, 10*time.Millisecond)
+	}
+	check("many healthy requests", 8)
+
+	fixed := newLimiter("test", 8, false)
+	fixed.observe(http.StatusTooManyRequests, 10*time.Millisecond)
+	if fixed.limit != 8 {
+		t.Errorf("429 lowered the limit of a limiter that does not adapt to %d", fixed.limit)
+	}
+}
+
+// acquired acquires l in the background, the returned channel receives the
+// result of acquire.
+func acquired(ctx context.Context, l *limiter) <-chan error {
+	result := make(chan error, 1)
+	go func() { result <- l.acquire(ctx) }()
+	return result
+}
+
+// waiting fails the test unless result is still waiting for a slot.
+func waiting(t *testing.T, step string, result <-chan error) {
+	t.Helper()
+	select {
+	case err := <-result:
+		t.Fatalf("%s: acquired a slot: %v", step, err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// granted fails the test unless result receives a slot.
+func granted(t *testing.T, step string, result <-chan error) {
+	t.Helper()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%s: still waiting for a slot", step)
+	}
+}
+
+func TestLimiterAcquire(t *testing.T) {
+	ctx := context.Background()
+	l := newLimiter("test", 2, false)
+	granted(t, "first slot", acquired(ctx, l))
+	granted(t, "second slot", acquired(ctx, l))
+	third := acquired(ctx, l)
+	waiting(t, "third slot", third)
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	canceled := acquired(canceledCtx, l)
+	waiting(t, "fourth slot", canceled)
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("canceled waiter returned %v", err)
+	}
+
+	l.release()
+	granted(t, "third slot after a release", third)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active != 2 || len(l.waiters) != 0 {
+		t.Errorf("%d slots held and %d waiters, want 2 and none", l.active, len(l.waiters))
+	}
+}
+
+func TestLimiterRelease(t *testing.T) {
+	ctx := context.Background()
+	l := newLimiter("test", 4, true)
+	for i := 0; i < 4; i++ {
+		granted(t, "slot", acquired(ctx, l))
+	}
+	l.observe(http.StatusTooManyRequests, 10*time.Millisecond)
+	waiter := acquired(ctx, l)
+	waiting(t, "over the lowered limit", waiter)
+
+	// the slots held over the lowered limit are not handed over
+	l.release()
+	l.release()
+	waiting(t, "at the lowered limit", waiter)
+	l.release()
+	granted(t, "under the lowered limit", waiter)
+}
+
+func TestLimiterWakeAfterRaising(t *testing.T) {
+	ctx := context.Background()
+	l := newLimiter("test", 2, true)
+	l.observe(http.StatusTooManyRequests, 10*time.Millisecond)
+	granted(t, "slot", acquired(ctx, l))
+	waiter := acquired(ctx, l)
+	waiting(t, "at the lowered limit", waiter)
+
+	// a healthy request raises the limit of 1 back to 2, which hands the new
+	// slot over without a release
+	l.observe(http.StatusOK, 10*time.Millisecond)
+	granted(t, "after raising the limit", waiter)
+}
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// Tags lists the tags of a repository, following the pages the registry links
+// to.
+func (r *DockerRegistry) Tags(ctx context.Context, repo string) ([]string, error) {
+	var tags []string
+	err := r.list(ctx, r.urlf("/v2/%s/tags/list", repo), "list tags of", repo, func(body io.Reader) error {
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		if err := json.NewDecoder(body).Decode(&page); err != nil {
+			return err
+		}
+		tags = append(tags, page.Tags...)
+		return nil
+	})
+	return tags, err
+}
+
+// Catalog lists the repositories of the registry, following the pages the
+// registry links to.
+func (r *DockerRegistry) Catalog(ctx context.Context) ([]string, error) {
+	var repos []string
+	err := r.list(ctx, r.url("/v2/_catalog"), "list repositories", "", func(body io.Reader) error {
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		if err := json.NewDecoder(body).Decode(&page); err != nil {
+			return err
+		}
+		repos = append(repos, page.Repositories...)
+		return nil
+	})
+	return repos, err
+}
+
+// list fetches the pages of a list starting at url, decoding each of them,
+// up to the page without a Link to a next one.
+func (r *DockerRegistry) list(ctx context.Context, url string, op string, repo string, decode func(io.Reader) error) error {
+	what := strings.TrimSpace(op + " " + repo)
+	for url != "" {
+		debugf(r.debug, "listing %s", url)
+		resp, err := ctxhttp.Get(ctx, r.Client, url)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := newError(resp, op, repo, "")
+			resp.Body.Close()
+			return err
+		}
+		err = decode(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to %s: invalid page %s: %w", what, url, err)
+		}
+
+		next, err := nextPage(resp)
+		if err != nil {
+			return fmt.Errorf("failed to %s: %w", what, err)
+		}
+		if next == url {
+			return fmt.Errorf("failed to %s: page %s links to itself", what, url)
+		}
+		url = next
+	}
+	return nil
+}
+
+// nextPage returns the URL of the Link with rel="next" of a response,
+// resolved against the URL of the request, or an empty URL on the last page.
+func nextPage(resp *http.Response) (string, error) {
+	for _, header := range resp.Header.Values("Link") {
+		for _, link := range strings.Split(header, ",") {
+			target, params, _ := strings.Cut(link, ";")
+			if !isNext(params) {
+				continue
+			}
+			target = strings.TrimSpace(target)
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				return "", fmt.Errorf("invalid Link header %q", header)
+			}
+			next, err := resp.Request.URL.Parse(strings.Trim(target, "<>"))
+			if err != nil {
+				return "", fmt.Errorf("invalid Link header %q: %w", header, err)
+			}
+			return next.String(), nil
+		}
+	}
+	return "", nil
+}
+
+func isNext(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, "rel") && strings.Trim(value, `"`) == "next" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestTagsPagination(t *testing.T) {
+	tests := []struct {
+		name    string
+		link    func(srv string, last int) string
+		want    []string
+		wantErr bool
+	}{
+		{
+			"relative links",
+			func(_ string, last int) string {
+				return `</v2/library/nginx/tags/list?n=2&last=` + strconv.Itoa(last) + `>; rel="next"`
+			},
+			[]string{"t0", "t1", "t2", "t3", "t4"}, false,
+		},
+		{
+			"absolute links among others",
+			func(srv string, last int) string {
+				return `<` + srv + `/v2/library/nginx/tags/list?n=2&last=` + strconv.Itoa(last) + `>; rel=next, <https://docs.test>; rel="help"`
+			},
+			[]string{"t0", "t1", "t2", "t3", "t4"}, false,
+		},
+		{"invalid link", func(string, int) string { return `/v2/library/nginx/tags/list; rel="next"` }, nil, true},
+		{"link to itself", func(string, int) string { return `</v2/library/nginx/tags/list>; rel="next"` }, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				first := 0
+				if last := r.URL.Query().Get("last"); last != "" {
+					first, _ = strconv.Atoi(last)
+					first++
+				}
+				var tags []string
+				for i := first; i < min(first+2, 5); i++ {
+					tags = append(tags, "t"+strconv.Itoa(i))
+				}
+				if first+2 < 5 {
+					w.Header().Set("Link", tt.link(srv.URL, first+1))
+				}
+				json.NewEncoder(w).Encode(map[string]any{"name": "library/nginx", "tags": tags})
+			}))
+			defer srv.Close()
+
+			tags, err := NewRegistry(srv.URL, WithCredential("test", "test")).Tags(context.Background(), "library/nginx")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Tags() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(tags, tt.want) {
+				t.Errorf("Tags() = %v, want %v", tags, tt.want)
+			}
+		})
+	}
+}
+
+func TestCatalogPagination(t *testing.T) {
+	repos := []string{"library/nginx", "library/redis", "team/app", "team/tool", "web"}
+	var pages []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages = append(pages, r.URL.RawQuery)
+		first := 0
+		if last := r.URL.Query().Get("last"); last != "" {
+			for first < len(repos) && repos[first] <= last {
+				first++
+			}
+		}
+		page := repos[first:min(first+2, len(repos))]
+		if first+2 < len(repos) {
+			w.Header().Set("Link", `</v2/_catalog?n=2&last=`+page[len(page)-1]+`>; rel="next"`)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"repositories": page})
+	}))
+	defer srv.Close()
+
+	got, err := NewRegistry(srv.URL, WithCredential("test", "test")).Catalog(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, repos) {
+		t.Errorf("Catalog() = %v, want %v", got, repos)
+	}
+	if want := []string{"", "n=2&last=library/redis", "n=2&last=team/tool"}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("requested pages %q, want %q", pages, want)
+	}
+}
@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+
+	"github.com/distribution/distribution/manifest/manifestlist"
+	// registers the OCI image manifest with distribution.UnmarshalManifest
+	_ "github.com/distribution/distribution/manifest/ocischema"
+	manifestV2 "github.com/distribution/distribution/manifest/schema2"
+	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ManifestMediaTypes are the manifest formats the registry clients accept.
+var ManifestMediaTypes = []string{
+	manifestV2.MediaTypeManifest,
+	v1.MediaTypeImageManifest,
+	manifestlist.MediaTypeManifestList,
+	v1.MediaTypeImageIndex,
+}
+
+// Manifest is a manifest of any media type, kept as the exact bytes the
+// registry served so that it can be pushed again under the same digest.
+type Manifest struct {
+	MediaType string
+	Digest    digest.Digest
+	Payload   []byte
+}
+
+func NewManifest(mediaType string, payload []byte) Manifest {
+	return Manifest{
+		MediaType: manifestMediaType(mediaType, payload),
+		Digest:    digest.FromBytes(payload),
+		Payload:   payload,
+	}
+}
+
+// IsIndex reports whether the manifest is a docker manifest list or an OCI
+// image index.
+func (m Manifest) IsIndex() bool {
+	return m.MediaType == manifestlist.MediaTypeManifestList || m.MediaType == v1.MediaTypeImageIndex
+}
+
+// References returns the blobs the manifest refers to, config first.
+func (m Manifest) References() ([]distribution.Descriptor, error) {
+	if m.IsIndex() {
+		return nil, fmt.Errorf("manifest %s is an index and does not refer to blobs", m.Digest)
+	}
+	manifest, _, err := distribution.UnmarshalManifest(m.MediaType, m.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %v", m.Digest, err)
+	}
+	return manifest.References(), nil
+}
+
+// Manifests returns the manifests an index refers to.
+func (m Manifest) Manifests() ([]manifestlist.ManifestDescriptor, error) {
+	if !m.IsIndex() {
+		return nil, fmt.Errorf("manifest %s is not an index", m.Digest)
+	}
+	index := manifestlist.ManifestList{}
+	if err := json.Unmarshal(m.Payload, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse index %s: %v", m.Digest, err)
+	}
+	return index.Manifests, nil
+}
+
+// FilterManifests rewrites an index to list only the manifests keep returns
+// true for. Every other field of the index is preserved as is, but the
+// result has a new digest.
+func (m Manifest) FilterManifests(keep func(manifestlist.ManifestDescriptor) bool) (Manifest, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(m.Payload, &fields); err != nil {
+		return Manifest{}, fmt.Errorf("failed to parse index %s: %v", m.Digest, err)
+	}
+	var raws []json.RawMessage
+	if err := json.Unmarshal(fields["manifests"], &raws); err != nil {
+		return Manifest{}, fmt.Errorf("failed to parse manifests of index %s: %v", m.Digest, err)
+	}
+
+	kept := make([]json.RawMessage, 0, len(raws))
+	for _, raw := range raws {
+		descriptor := manifestlist.ManifestDescriptor{}
+		if err := json.Unmarshal(raw, &descriptor); err != nil {
+			return Manifest{}, fmt.Errorf("failed to parse manifests of index %s: %v", m.Digest, err)
+		}
+		if keep(descriptor) {
+			kept = append(kept, raw)
+		}
+	}
+
+	manifests, err := json.Marshal(kept)
+	if err != nil {
+		return Manifest{}, err
+	}
+	fields["manifests"] = manifests
+	payload, err := json.MarshalIndent(fields, "", "   ")
+	if err != nil {
+		return Manifest{}, err
+	}
+	return NewManifest(m.MediaType, payload), nil
+}
+
+// manifestMediaType prefers the mediaType field of the payload when the
+// Content-Type header is missing or generic.
+func manifestMediaType(contentType string, payload []byte) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	for _, t := range ManifestMediaTypes {
+		if t == contentType {
+			return contentType
+		}
+	}
+
+	var versioned struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(payload, &versioned); err == nil && versioned.MediaType != "" {
+		return versioned.MediaType
+	}
+	return contentType
+}
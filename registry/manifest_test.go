@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/manifest/manifestlist"
+	manifestV2 "github.com/distribution/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestManifestMediaType(t *testing.T) {
+	oci := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	untyped := []byte(`{"schemaVersion":2,"config":{}}`)
+	tests := []struct {
+		name        string
+		contentType string
+		payload     []byte
+		want        string
+	}{
+		{"header", manifestV2.MediaTypeManifest, oci, manifestV2.MediaTypeManifest},
+		{"header with parameters", v1.MediaTypeImageIndex + "; charset=utf-8", oci, v1.MediaTypeImageIndex},
+		{"missing header", "", oci, v1.MediaTypeImageManifest},
+		{"generic header", "application/json", oci, v1.MediaTypeImageManifest},
+		{"octet stream", "application/octet-stream", oci, v1.MediaTypeImageManifest},
+		{"generic header, untyped payload", "application/json", untyped, "application/json"},
+		{"invalid payload", "text/plain", []byte("not json"), "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := manifestMediaType(tt.contentType, tt.payload); got != tt.want {
+				t.Errorf("manifestMediaType(%q) = %s, want %s", tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewManifestKeepsBytes(t *testing.T) {
+	// indented, with keys out of the canonical order and a trailing newline
+	payload := []byte("{\n  \"mediaType\": \"application/vnd.oci.image.manifest.v1+json\",\n  \"schemaVersion\": 2,\n" +
+		"  \"config\": {\"mediaType\": \"application/vnd.oci.image.config.v1+json\", \"size\": 2, \"digest\": \"" + digest.FromString("{}").String() + "\"},\n" +
+		"  \"layers\": []\n}\n")
+	m := NewManifest("", payload)
+	if m.Digest != digest.FromBytes(payload) || string(m.Payload) != string(payload) {
+		t.Errorf("manifest digest %s of %q, want the digest of the served bytes", m.Digest, m.Payload)
+	}
+	if m.IsIndex() {
+		t.Error("image manifest taken for an index")
+	}
+	refs, err := m.References()
+	if err != nil || len(refs) != 1 || refs[0].Digest != digest.FromString("{}") {
+		t.Errorf("References() = %v, %v, want the config", refs, err)
+	}
+}
+
+func TestFilterManifests(t *testing.T) {
+	payload := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","annotations":{"a":"b"},"manifests":[` +
+		`{"mediaType":"application/vnd.oci.image.manifest.v1+json","size":1,"digest":"` + digest.FromString("amd64").String() + `","platform":{"os":"linux","architecture":"amd64"},"annotations":{"keep":"me"}},` +
+		`{"mediaType":"application/vnd.oci.image.manifest.v1+json","size":1,"digest":"` + digest.FromString("arm64").String() + `","platform":{"os":"linux","architecture":"arm64"}}]}`
+	index := NewManifest(v1.MediaTypeImageIndex, []byte(payload))
+
+	filtered, err := index.FilterManifests(func(d manifestlist.ManifestDescriptor) bool {
+		return d.Platform.Architecture == "amd64"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := filtered.Manifests()
+	if err != nil || len(manifests) != 1 || manifests[0].Digest != digest.FromString("amd64") {
+		t.Fatalf("filtered manifests %v, %v", manifests, err)
+	}
+	for _, kept := range []string{`"annotations"`, `"keep": "me"`, `"schemaVersion": 2`} {
+		if !strings.Contains(string(filtered.Payload), kept) {
+			t.Errorf("filtered index lost %s: %s", kept, filtered.Payload)
+		}
+	}
+	if filtered.MediaType != index.MediaType || filtered.Digest != digest.FromBytes(filtered.Payload) {
+		t.Errorf("filtered index %s %s", filtered.MediaType, filtered.Digest)
+	}
+}
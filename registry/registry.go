@@ -9,36 +9,123 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
-	manifestV2 "github.com/distribution/distribution/manifest/schema2"
 	"github.com/opencontainers/go-digest"
 	"golang.org/x/net/context/ctxhttp"
 )
 
 type DockerRegistry struct {
-	URL    string
-	Client *http.Client
+	URL             string
+	Client          *http.Client
+	credential      Credential
+	credentialsFile string
+	chunkSize       int64
+	retryPolicy     RetryPolicy
+	limits          Limits
+	timeout         time.Duration
+	debug           *log.Logger
 }
 
-func NewRegistry(url string) Registry {
-	u := strings.TrimSuffix(url, "/")
-	return &DockerRegistry{
-		URL: u,
-		Client: &http.Client{
-			Transport: http.DefaultTransport,
-		},
+type Option func(*DockerRegistry)
+
+func WithCredential(username string, password string) Option {
+	return func(r *DockerRegistry) {
+		r.credential = Credential{Username: username, Password: password}
+	}
+}
+
+func WithCredentialsFile(path string) Option {
+	return func(r *DockerRegistry) {
+		r.credentialsFile = path
+	}
+}
+
+// WithChunkSize uploads blobs in chunks of size bytes which can be resumed
+// after a failure, instead of in a single request.
+func WithChunkSize(size int64) Option {
+	return func(r *DockerRegistry) {
+		r.chunkSize = size
+	}
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy for the requests to the
+// registry.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(r *DockerRegistry) {
+		r.retryPolicy = policy
+	}
+}
+
+// WithLimits bounds the concurrent requests to the registry.
+func WithLimits(limits Limits) Option {
+	return func(r *DockerRegistry) {
+		r.limits = limits
+	}
+}
+
+// WithTimeout bounds how long the registry may take to answer a request,
+// excluding the time to transfer the body.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *DockerRegistry) {
+		r.timeout = timeout
 	}
 }
 
+// WithDebugLog logs the requests to the registry, such as fetching a
+// manifest or uploading a layer, to logger. Retries and other failures are
+// logged to the standard logger either way.
+func WithDebugLog(logger *log.Logger) Option {
+	return func(r *DockerRegistry) {
+		r.debug = logger
+	}
+}
+
+// NewRegistry creates a client of the registry at rawURL. Unless a credential
+// is given with WithCredential, it is resolved by ResolveCredential.
+func NewRegistry(rawURL string, opts ...Option) Registry {
+	u := strings.TrimSuffix(rawURL, "/")
+	r := &DockerRegistry{
+		URL:         u,
+		retryPolicy: DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	host := ""
+	if parsed, err := url.Parse(u); err == nil {
+		host = parsed.Host
+	}
+	if r.credential.empty() {
+		c, err := ResolveCredential(configHost(host), r.credentialsFile)
+		if err != nil {
+			log.Printf("registry: failed to resolve credential of %s: %v", host, err)
+		}
+		r.credential = c
+	}
+	// the limits sit below the retries so that adaptive limits see every 429
+	base := http.DefaultTransport
+	if r.timeout > 0 {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = r.timeout
+		base = transport
+	}
+	limited := newLimitTransport(base, host, r.limits)
+	r.Client = &http.Client{
+		Transport: newAuthTransport(&retryTransport{base: limited, policy: r.retryPolicy}, host, r.credential, r.debug),
+	}
+	return r
+}
+
 func (r *DockerRegistry) Ping() error {
-	url := r.url("/v2/")
-	resp, err := r.Client.Get(url)
+	resp, err := r.Client.Get(r.url("/v2/"))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("ping failed with status code: %d", resp.StatusCode)
+		return newError(resp, "ping registry", "", "")
 	}
 	return nil
 }
@@ -51,69 +138,77 @@ func (r *DockerRegistry) urlf(format string, a ...interface{}) string {
 	return fmt.Sprintf(r.url(format), a...)
 }
 
-func (r *DockerRegistry) ManifestV2Exists(ctx context.Context, repo string, ref string) (bool, error) {
+// ManifestV2Exists reports whether the manifest exists along with its
+// Docker-Content-Digest, the digest is empty when the registry omits it.
+func (r *DockerRegistry) ManifestV2Exists(ctx context.Context, repo string, ref string) (bool, digest.Digest, error) {
 	url := r.url(fmt.Sprintf("/v2/%s/manifests/%s", repo, ref))
-	resp, err := ctxhttp.Head(ctx, r.Client, url)
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Accept", strings.Join(ManifestMediaTypes, ", "))
+	resp, err := ctxhttp.Do(ctx, r.Client, req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
-	if err == nil && resp.StatusCode == http.StatusOK {
-		// to-do
-		// compare the digest of image
-		return true, nil
+	if err != nil {
+		return false, "", err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return false, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, "", newError(resp, "check manifest", repo, ref)
 	}
+
+	dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
 	if err != nil {
-		return false, err
+		return true, "", nil
 	}
-	return false, nil
+	return true, dgst, nil
 }
 
-func (r *DockerRegistry) ManifestV2(ctx context.Context, repo string, ref string) (manifestV2.DeserializedManifest, error) {
+func (r *DockerRegistry) Manifest(ctx context.Context, repo string, ref string) (Manifest, error) {
 	url := r.url(fmt.Sprintf("/v2/%s/manifests/%s", repo, ref))
-	log.Printf("registry: fetching manifest from %s", url)
+	debugf(r.debug, "fetching manifest from %s", url)
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return manifestV2.DeserializedManifest{}, err
+		return Manifest{}, err
 	}
 
-	req.Header.Set("Accept", manifestV2.MediaTypeManifest)
+	req.Header.Set("Accept", strings.Join(ManifestMediaTypes, ", "))
 	resp, err := ctxhttp.Do(ctx, r.Client, req)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 	if err != nil {
-		return manifestV2.DeserializedManifest{}, err
+		return Manifest{}, err
 	}
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return manifestV2.DeserializedManifest{}, err
+	if resp.StatusCode != http.StatusOK {
+		return Manifest{}, newError(resp, "fetch manifest", repo, ref)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return manifestV2.DeserializedManifest{}, fmt.Errorf("failed to fetch manifest %s:%s, status code: %d,error message: %s", repo, ref, resp.StatusCode, string(data))
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Manifest{}, err
 	}
 
-	d := manifestV2.DeserializedManifest{}
-	if err := d.UnmarshalJSON(data); err != nil {
-		return manifestV2.DeserializedManifest{}, err
+	manifest := NewManifest(resp.Header.Get("Content-Type"), data)
+	if dgst, err := digest.Parse(ref); err == nil && dgst != manifest.Digest {
+		return Manifest{}, fmt.Errorf("manifest %s@%s does not match its digest, got %s", repo, ref, manifest.Digest)
 	}
-	return d, nil
+	return manifest, nil
 }
 
-func (r *DockerRegistry) ManifestV2Put(ctx context.Context, repo string, ref string, manifest manifestV2.DeserializedManifest) error {
+func (r *DockerRegistry) ManifestPut(ctx context.Context, repo string, ref string, manifest Manifest) error {
 	url := r.urlf("/v2/%s/manifests/%s", repo, ref)
-	log.Printf("registry: putting manifest to %s", url)
-	data, err := manifest.MarshalJSON()
+	debugf(r.debug, "putting manifest to %s", url)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(manifest.Payload))
 	if err != nil {
 		return err
 	}
-	buffer := bytes.NewBuffer(data)
-	req, err := http.NewRequest(http.MethodPut, url, buffer)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", manifestV2.MediaTypeManifest)
+	req.Header.Set("Content-Type", manifest.MediaType)
 	resp, err := ctxhttp.Do(ctx, r.Client, req)
 	if resp != nil {
 		defer resp.Body.Close()
@@ -123,80 +218,45 @@ func (r *DockerRegistry) ManifestV2Put(ctx context.Context, repo string, ref str
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to put manifest of image %s:%s, status code: %d", repo, ref, resp.StatusCode)
+		return newError(resp, "put manifest", repo, ref)
+	}
+	if dgst := resp.Header.Get("Docker-Content-Digest"); dgst != "" && dgst != manifest.Digest.String() {
+		return fmt.Errorf("manifest of image %s:%s stored with digest %s, expected %s", repo, ref, dgst, manifest.Digest)
 	}
 	return nil
 }
 
 func (r *DockerRegistry) LayerExists(ctx context.Context, repo string, digest digest.Digest) (bool, error) {
 	url := r.urlf("/v2/%s/blobs/%s", repo, digest)
-	log.Printf("registry: checking layer exists %s", url)
+	debugf(r.debug, "checking layer exists %s", url)
 
 	resp, err := ctxhttp.Head(ctx, r.Client, url)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 
-	if err == nil && resp.StatusCode == http.StatusOK {
-		return true, nil
-	}
-
 	if err != nil {
 		return false, err
 	}
 
-	return false, nil
-}
-
-func (r *DockerRegistry) LayerDownload(ctx context.Context, repo string, digest digest.Digest) (io.ReadCloser, error) {
-	url := r.urlf("/v2/%s/blobs/%s", repo, digest)
-	log.Printf("registry: downloading layer from %s", url)
-	resp, err := ctxhttp.Get(ctx, r.Client, url)
-	if err != nil {
-		return nil, err
-	}
-	return resp.Body, nil
-}
-
-func (r *DockerRegistry) LayerUpload(ctx context.Context, repo string, digest digest.Digest, reader io.Reader) error {
-	url, err := r.initiateUpload(ctx, repo)
-	if err != nil {
-		return err
-	}
-	query := url.Query()
-	query.Set("digest", digest.String())
-	url.RawQuery = query.Encode()
-	log.Printf("registry: uploading layer to %s", url.String())
-
-	locationURL := url.String()[strings.Index(url.String(), "v2")-1:]
-	uploadURL := r.url(locationURL)
-	req, err := http.NewRequest(http.MethodPut, uploadURL, reader)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/octet-stream")
-	resp, err := ctxhttp.Do(ctx, r.Client, req)
-	if resp != nil {
-		defer resp.Body.Close()
-	}
-	if err != nil {
-		return err
-	}
-
-	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to upload layer %s, status code: %d, location url: %v", digest, resp.StatusCode, locationURL)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
 	}
-
-	return nil
+	return false, newError(resp, "check layer", repo, digest.String())
 }
 
-func (r *DockerRegistry) LayerMount(ctx context.Context, repo string, digest digest.Digest) error {
-	mountURL := r.urlf("/v2/%s/blobs/uploads/", repo)
-	log.Printf("registry: mounting layer to %s", mountURL)
+// LayerMount mounts a blob of the repository from into repo without
+// uploading it again.
+func (r *DockerRegistry) LayerMount(ctx context.Context, repo string, from string, digest digest.Digest) error {
 	values := url.Values{}
 	values.Add("mount", digest.String())
-	values.Add("from", "trunk")
-	resp, err := ctxhttp.PostForm(ctx, r.Client, mountURL, values)
+	values.Add("from", from)
+	mountURL := r.urlf("/v2/%s/blobs/uploads/?%s", repo, values.Encode())
+	debugf(r.debug, "mounting layer to %s", mountURL)
+	resp, err := ctxhttp.Post(ctx, r.Client, mountURL, "", nil)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -205,33 +265,21 @@ func (r *DockerRegistry) LayerMount(ctx context.Context, repo string, digest dig
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to mount layer %s of repository %s, status code: %d", digest, repo, resp.StatusCode)
+		err := newError(resp, "mount layer from "+from+" into", repo, digest.String())
+		// 202 means the registry could not mount and opened an upload session instead
+		if resp.StatusCode == http.StatusAccepted {
+			if location, parseErr := url.Parse(resp.Header.Get("Location")); parseErr == nil && location.Path != "" {
+				r.cancelUpload(ctx, location)
+			}
+		}
+		return err
 	}
 	return nil
 }
 
-func (r *DockerRegistry) initiateUpload(ctx context.Context, repo string) (*url.URL, error) {
-	initiateURL := r.urlf("/v2/%s/blobs/uploads/", repo)
-	log.Printf("registry: initiating upload to %s", initiateURL)
-	resp, err := ctxhttp.Post(ctx, r.Client, initiateURL, "application/octet-stream", nil)
-	if resp != nil {
-		defer resp.Body.Close()
-	}
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != http.StatusAccepted {
-		return nil, fmt.Errorf("failed to initiate upload to %s, status code: %d", initiateURL, resp.StatusCode)
-	}
-
-	location := resp.Header.Get("Location")
-	if location == "" {
-		return nil, fmt.Errorf("failed to initiate upload to %s, location header is empty", initiateURL)
-	}
-	locationURL, err := url.Parse(location)
-	if err != nil {
-		return nil, err
+// debugf logs a request to logger, nil drops it.
+func debugf(logger *log.Logger, format string, args ...any) {
+	if logger != nil {
+		logger.Printf("registry: "+format, args...)
 	}
-	return locationURL, nil
 }
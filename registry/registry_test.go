@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// requestLog records the requests of a test server as "METHOD path".
+type requestLog struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (l *requestLog) add(r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests = append(l.requests, r.Method+" "+r.URL.Path)
+}
+
+func (l *requestLog) count(request string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, r := range l.requests {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLayerMount(t *testing.T) {
+	dgst := digest.FromString("layer")
+	tests := []struct {
+		name     string
+		status   int
+		err      bool
+		canceled bool
+	}{
+		{"mounted", http.StatusCreated, false, false},
+		{"upload session opened instead", http.StatusAccepted, true, true},
+		{"denied", http.StatusForbidden, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &requestLog{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				log.add(r)
+				switch r.Method {
+				case http.MethodPost:
+					if r.URL.Query().Get("mount") != dgst.String() || r.URL.Query().Get("from") != "library/nginx" {
+						t.Errorf("mount request %s", r.URL)
+					}
+					w.Header().Set("Location", "/v2/mirror/nginx/blobs/uploads/1")
+					w.WriteHeader(tt.status)
+				case http.MethodDelete:
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+			defer srv.Close()
+
+			err := NewRegistry(srv.URL, WithCredential("test", "test")).LayerMount(context.Background(), "mirror/nginx", "library/nginx", dgst)
+			if (err != nil) != tt.err {
+				t.Errorf("LayerMount: %v, want error %v", err, tt.err)
+			}
+			if got := log.count("DELETE /v2/mirror/nginx/blobs/uploads/1") == 1; got != tt.canceled {
+				t.Errorf("upload session canceled: %v, want %v", got, tt.canceled)
+			}
+		})
+	}
+}
+
+func TestDebugLog(t *testing.T) {
+	var stdLog bytes.Buffer
+	log.SetOutput(&stdLog)
+	defer log.SetOutput(os.Stderr)
+
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	for _, debug := range []bool{false, true} {
+		stdLog.Reset()
+		var debugLog bytes.Buffer
+		attempts = 0
+		opts := []Option{WithCredential("test", "test"), WithRetryPolicy(testRetryPolicy)}
+		if debug {
+			opts = append(opts, WithDebugLog(log.New(&debugLog, "", 0)))
+		}
+		if _, err := NewRegistry(srv.URL, opts...).LayerExists(context.Background(), "library/nginx", digest.FromString("layer")); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(stdLog.String(), "answered 503, retrying") {
+			t.Errorf("debug %v: retry not logged: %q", debug, stdLog.String())
+		}
+		if strings.Contains(stdLog.String(), "checking layer") || strings.Contains(debugLog.String(), "retrying") {
+			t.Errorf("debug %v: requests in the log %q or retries in the debug log %q", debug, stdLog.String(), debugLog.String())
+		}
+		if got := strings.Contains(debugLog.String(), "registry: checking layer"); got != debug {
+			t.Errorf("debug %v: request logged %v: %q", debug, got, debugLog.String())
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy bounds how often and how long a registry request is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent, 1 disables retries
+	MaxAttempts int
+	// Budget is the total time a request may take including all its retries
+	Budget    time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Budget:      2 * time.Minute,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// IsRetryable reports whether a failed registry call is worth repeating,
+// i.e. whether it failed on the network or with a status code the registry
+// uses for transient failures.
+func IsRetryable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return retryableStatus(e.StatusCode)
+	}
+	return retryableError(err)
+}
+
+// retryTransport repeats idempotent requests that fail with a retryable error
+// or status code, with jittered exponential backoff or as long as the
+// registry asks for with Retry-After.
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.policy.MaxAttempts <= 1 || !idempotent(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	deadline := time.Now().Add(t.policy.Budget)
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt == t.policy.MaxAttempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err == nil && !retryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if err != nil && !retryableError(err) {
+			return resp, err
+		}
+
+		delay := t.policy.backoff(attempt)
+		if err == nil {
+			if after, ok := retryAfter(resp); ok {
+				delay = after
+			}
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return resp, err
+		}
+		if err == nil {
+			log.Printf("registry: %s %s answered %d, retrying in %v", req.Method, req.URL.Redacted(), resp.StatusCode, delay)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		} else {
+			log.Printf("registry: %s %s failed, retrying in %v: %v", req.Method, req.URL.Redacted(), delay, err)
+		}
+
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Delay returns how long to wait before repeating a call whose attempt
+// failed with err: as long as the registry asked for with Retry-After, or the
+// backoff of the attempt.
+func (p RetryPolicy) Delay(attempt int, err error) time.Duration {
+	var e *Error
+	if errors.As(err, &e) && e.RetryAfter > 0 {
+		return e.RetryAfter
+	}
+	return p.backoff(attempt)
+}
+
+// backoff returns a random delay between half and all of the exponentially
+// growing delay of an attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// idempotent reports whether a request can be sent again safely. Blob upload
+// sessions are never repeated here: a PATCH or PUT against a session that
+// may have moved on is resumed or re-initiated by the caller instead. A
+// mount POST is, as a failed mount opens no session to pick up.
+func idempotent(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPut:
+		return strings.Contains(req.URL.Path, "/manifests/")
+	case http.MethodPost:
+		return req.URL.Query().Get("mount") != ""
+	}
+	return false
+}
+
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	return req, nil
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func retryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &certErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryAfter parses the Retry-After header of 429 and 503 responses, given
+// either in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
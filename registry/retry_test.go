@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// roundTripperFunc answers the requests of a transport under test.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func response(status int, header ...string) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+	for i := 0; i+1 < len(header); i += 2 {
+		resp.Header.Set(header[i], header[i+1])
+	}
+	return resp
+}
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Budget:      time.Minute,
+	BaseDelay:   time.Millisecond,
+	MaxDelay:    10 * time.Millisecond,
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		answers  []any // status codes or errors, the last one repeats
+		attempts int
+	}{
+		{"GET succeeds", http.MethodGet, "/v2/app/manifests/1", "", []any{200}, 1},
+		{"GET retried on 503", http.MethodGet, "/v2/app/manifests/1", "", []any{503, 200}, 2},
+		{"HEAD retried on reset", http.MethodHead, "/v2/app/blobs/sha256:a", "", []any{syscall.ECONNRESET, 200}, 2},
+		{"GET retried up to the attempts", http.MethodGet, "/v2/app/manifests/1", "", []any{502}, 3},
+		{"GET not retried on 404", http.MethodGet, "/v2/app/manifests/1", "", []any{404}, 1},
+		{"GET not retried on a certificate error", http.MethodGet, "/v2/app/manifests/1", "", []any{&net.OpError{Op: "dial", Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}}, 1},
+		{"manifest PUT retried", http.MethodPut, "/v2/app/manifests/1", "{}", []any{500, 201}, 2},
+		{"blob PUT not retried", http.MethodPut, "/v2/app/blobs/uploads/1", "data", []any{500}, 1},
+		{"PATCH not retried", http.MethodPatch, "/v2/app/blobs/uploads/1", "data", []any{503}, 1},
+		{"POST not retried", http.MethodPost, "/v2/app/blobs/uploads/", "", []any{503}, 1},
+		{"mount POST retried", http.MethodPost, "/v2/app/blobs/uploads/?mount=sha256:a&from=base", "", []any{429, 201}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			var bodies []string
+			transport := &retryTransport{policy: testRetryPolicy, base: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				answer := tt.answers[min(attempts, len(tt.answers)-1)]
+				attempts++
+				if req.Body != nil {
+					body, _ := io.ReadAll(req.Body)
+					bodies = append(bodies, string(body))
+				}
+				if err, ok := answer.(error); ok {
+					return nil, err
+				}
+				return response(answer.(int)), nil
+			})}
+
+			var body io.Reader
+			if tt.body != "" {
+				body = bytes.NewReader([]byte(tt.body))
+			}
+			req, _ := http.NewRequest(tt.method, "http://registry.test"+tt.path, body)
+			resp, err := transport.RoundTrip(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.attempts)
+			}
+			for _, b := range bodies {
+				if b != tt.body {
+					t.Errorf("attempt sent body %q, want %q", b, tt.body)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	var times []time.Time
+	transport := &retryTransport{
+		policy: RetryPolicy{MaxAttempts: 2, Budget: time.Minute, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		base: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			times = append(times, time.Now())
+			if len(times) == 1 {
+				return response(http.StatusTooManyRequests, "Retry-After", "1"), nil
+			}
+			return response(http.StatusOK), nil
+		}),
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://registry.test/v2/app/manifests/1", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("RoundTrip: %v, %v", resp, err)
+	}
+	if waited := times[1].Sub(times[0]); waited < time.Second {
+		t.Errorf("retried after %v, the registry asked for 1s", waited)
+	}
+
+	// a Retry-After beyond the budget is not waited for
+	transport.policy.Budget = 100 * time.Millisecond
+	times = nil
+	resp, err = transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests || len(times) != 1 {
+		t.Errorf("Retry-After beyond the budget: %d attempts, %v, %v", len(times), resp.StatusCode, err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		status int
+		value  string
+		min    time.Duration
+		max    time.Duration
+		ok     bool
+	}{
+		{429, "120", 120 * time.Second, 120 * time.Second, true},
+		{503, "0", 0, 0, true},
+		{429, date, 59 * time.Minute, time.Hour, true},
+		{429, "Wed, 21 Oct 2015 07:28:00 GMT", 0, 0, true},
+		{429, "", 0, 0, false},
+		{429, "soon", 0, 0, false},
+		{429, "-1", 0, 0, false},
+		{500, "120", 0, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(response(tt.status, "Retry-After", tt.value))
+		if ok != tt.ok || got < tt.min || got > tt.max {
+			t.Errorf("retryAfter(%d, %q) = %v, %v, want %v-%v, %v", tt.status, tt.value, got, ok, tt.min, tt.max, tt.ok)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		err     error
+		min     time.Duration
+		max     time.Duration
+	}{
+		{1, &Error{StatusCode: http.StatusServiceUnavailable}, 500 * time.Microsecond, time.Millisecond},
+		{3, syscall.ECONNRESET, 2 * time.Millisecond, 4 * time.Millisecond},
+		{10, syscall.ECONNRESET, 5 * time.Millisecond, 10 * time.Millisecond},
+		{1, fmt.Errorf("upload: %w", &Error{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}), time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := testRetryPolicy.Delay(tt.attempt, tt.err); got < tt.min || got > tt.max {
+			t.Errorf("Delay(%d, %v) = %v, want %v-%v", tt.attempt, tt.err, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&Error{StatusCode: http.StatusServiceUnavailable}, true},
+		{&Error{StatusCode: http.StatusTooManyRequests}, true},
+		{&Error{StatusCode: http.StatusNotFound}, false},
+		{fmt.Errorf("upload: %w", &Error{StatusCode: http.StatusBadGateway}), true},
+		{syscall.ECONNRESET, true},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("invalid manifest"), false},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// maxUploadResumes is how many times a failed chunk is resumed from the
+// offset the registry reports before the upload is given up.
+const maxUploadResumes = 3
+
+// cancelTimeout bounds the request deleting an upload session, which is
+// sent even when the upload was canceled.
+const cancelTimeout = 10 * time.Second
+
+func (r *DockerRegistry) LayerUpload(ctx context.Context, repo string, digest digest.Digest, reader io.Reader) error {
+	location, err := r.initiateUpload(ctx, repo)
+	if err != nil {
+		return err
+	}
+	if r.chunkSize > 0 {
+		location, err = r.uploadChunks(ctx, location, reader)
+		if err != nil {
+			r.cancelUpload(ctx, location)
+			return fmt.Errorf("failed to upload layer %s: %w", digest, err)
+		}
+		reader = nil
+	}
+
+	complete := *location
+	query := complete.Query()
+	query.Set("digest", digest.String())
+	complete.RawQuery = query.Encode()
+	debugf(r.debug, "uploading layer to %s", complete.String())
+
+	uploadURL := r.uploadURL(&complete)
+	req, err := http.NewRequest(http.MethodPut, uploadURL, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := ctxhttp.Do(ctx, r.Client, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		// e.g. the stream was aborted as corrupted before the blob was committed
+		r.cancelUpload(ctx, location)
+		return err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		err := newError(resp, "upload layer", repo, digest.String())
+		r.cancelUpload(ctx, location)
+		return err
+	}
+
+	return nil
+}
+
+// uploadChunks PATCHes the content of reader to an upload session chunk by
+// chunk and returns the location to complete the upload at, or the last
+// location of the session when it fails. A chunk that fails is resumed from
+// the offset the registry reports for the session.
+func (r *DockerRegistry) uploadChunks(ctx context.Context, location *url.URL, reader io.Reader) (*url.URL, error) {
+	buf := make([]byte, r.chunkSize)
+	offset := int64(0)
+	for {
+		n, readErr := io.ReadFull(reader, buf)
+		if n > 0 {
+			var err error
+			location, err = r.uploadChunk(ctx, location, buf[:n], offset)
+			chunkErr := err
+			for resumes := 0; err != nil; resumes++ {
+				if ctx.Err() != nil {
+					return location, err
+				}
+				if resumes == maxUploadResumes {
+					return location, fmt.Errorf("failed to resume upload (%v): %w", err, chunkErr)
+				}
+				log.Printf("registry: chunk at offset %d failed, resuming: %v", offset, err)
+				location, err = r.resumeChunk(ctx, location, buf[:n], offset)
+			}
+			offset += int64(n)
+		}
+
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return location, nil
+		}
+		if readErr != nil {
+			return location, readErr
+		}
+	}
+}
+
+// resumeChunk asks the registry how much of the session it holds and uploads
+// whatever of the chunk starting at offset is still missing.
+func (r *DockerRegistry) resumeChunk(ctx context.Context, location *url.URL, chunk []byte, offset int64) (*url.URL, error) {
+	location, size, err := r.uploadStatus(ctx, location)
+	if err != nil {
+		return location, err
+	}
+	if size < offset || size > offset+int64(len(chunk)) {
+		return location, fmt.Errorf("cannot resume upload, registry holds %d bytes, chunk covers %d-%d", size, offset, offset+int64(len(chunk)))
+	}
+	if size == offset+int64(len(chunk)) {
+		return location, nil
+	}
+	return r.uploadChunk(ctx, location, chunk[size-offset:], size)
+}
+
+func (r *DockerRegistry) uploadChunk(ctx context.Context, location *url.URL, chunk []byte, offset int64) (*url.URL, error) {
+	req, err := http.NewRequest(http.MethodPatch, r.uploadURL(location), bytes.NewReader(chunk))
+	if err != nil {
+		return location, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(len(chunk))-1))
+	resp, err := ctxhttp.Do(ctx, r.Client, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return location, err
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		return location, newError(resp, fmt.Sprintf("upload chunk %d-%d", offset, offset+int64(len(chunk))-1), "", "")
+	}
+	return nextLocation(location, resp)
+}
+
+// uploadStatus returns the number of bytes the registry holds for an upload
+// session.
+func (r *DockerRegistry) uploadStatus(ctx context.Context, location *url.URL) (*url.URL, int64, error) {
+	resp, err := ctxhttp.Get(ctx, r.Client, r.uploadURL(location))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return location, 0, err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return location, 0, newError(resp, "get upload status", "", "")
+	}
+	location, err = nextLocation(location, resp)
+	if err != nil {
+		return location, 0, err
+	}
+
+	// Range is inclusive, 0-0 is what registries report for an empty session
+	_, end, ok := strings.Cut(resp.Header.Get("Range"), "-")
+	if !ok {
+		return location, 0, nil
+	}
+	last, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return location, 0, fmt.Errorf("invalid upload range %q", resp.Header.Get("Range"))
+	}
+	if last <= 0 {
+		return location, 0, nil
+	}
+	return location, last + 1, nil
+}
+
+func (r *DockerRegistry) initiateUpload(ctx context.Context, repo string) (*url.URL, error) {
+	initiateURL := r.urlf("/v2/%s/blobs/uploads/", repo)
+	debugf(r.debug, "initiating upload to %s", initiateURL)
+	resp, err := ctxhttp.Post(ctx, r.Client, initiateURL, "application/octet-stream", nil)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, newError(resp, "initiate upload to", repo, "")
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, fmt.Errorf("failed to initiate upload to %s, location header is empty", initiateURL)
+	}
+	locationURL, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	return locationURL, nil
+}
+
+// cancelUpload deletes an upload session that is given up, rather than
+// leaving it to the registry to expire.
+func (r *DockerRegistry) cancelUpload(ctx context.Context, location *url.URL) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cancelTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodDelete, r.uploadURL(location), nil)
+	if err != nil {
+		return
+	}
+	debugf(r.debug, "canceling upload %s", req.URL.Redacted())
+	resp, err := ctxhttp.Do(ctx, r.Client, req)
+	if err != nil {
+		log.Printf("registry: failed to cancel upload %s: %v", req.URL.Redacted(), err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		log.Printf("registry: failed to cancel upload %s: %v", req.URL.Redacted(), newError(resp, "cancel upload", "", ""))
+	}
+}
+
+// uploadURL rebases the path and query of an upload location on the registry
+// URL, registries behind proxies tend to answer with their internal host.
+func (r *DockerRegistry) uploadURL(location *url.URL) string {
+	base, err := url.Parse(r.URL)
+	if err != nil {
+		return location.String()
+	}
+	return base.ResolveReference(&url.URL{Path: location.Path, RawPath: location.RawPath, RawQuery: location.RawQuery}).String()
+}
+
+// nextLocation returns the Location of a response to an upload request,
+// every request of a session may move it.
+func nextLocation(location *url.URL, resp *http.Response) (*url.URL, error) {
+	next := resp.Header.Get("Location")
+	if next == "" {
+		return location, nil
+	}
+	parsed, err := url.Parse(next)
+	if err != nil {
+		return location, fmt.Errorf("invalid upload location %q: %w", next, err)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,196 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// uploadServer accepts blob uploads into a single session at location. The
+// PATCH numbered failPatch stores half of its chunk and answers 500, and the
+// status requests answer statusCode.
+type uploadServer struct {
+	*httptest.Server
+	location   string
+	failPatch  int
+	statusCode int
+
+	log     requestLog
+	mu      sync.Mutex
+	patches int
+	session []byte
+	blob    []byte
+	queries []string
+}
+
+func newUploadServer(t *testing.T, location string, failPatch int) *uploadServer {
+	s := &uploadServer{location: location, failPatch: failPatch, statusCode: http.StatusNoContent}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *uploadServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.log.add(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method != http.MethodPost {
+		s.queries = append(s.queries, r.URL.RawQuery)
+	}
+	switch r.Method {
+	case http.MethodPost:
+		w.Header().Set("Location", s.location)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		chunk, _ := io.ReadAll(r.Body)
+		s.patches++
+		if s.patches == s.failPatch || s.failPatch < 0 {
+			s.session = append(s.session, chunk[:len(chunk)/2]...)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.session = append(s.session, chunk...)
+		w.Header().Set("Location", s.location)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodGet:
+		if s.statusCode != http.StatusNoContent {
+			w.WriteHeader(s.statusCode)
+			return
+		}
+		w.Header().Set("Location", s.location)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", max(len(s.session)-1, 0)))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		blob := append(s.session, body...)
+		if digest.FromBytes(blob).String() != r.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.blob = blob
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestLayerUpload(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	tests := []struct {
+		name      string
+		chunkSize int64
+		location  string
+		failPatch int
+	}{
+		{"monolithic", 0, "/v2/mirror/app/blobs/uploads/1?_state=a", 0},
+		{"chunked", 8, "/v2/mirror/app/blobs/uploads/1?_state=a", 0},
+		{"chunk of the blob size", int64(len(content)), "/v2/mirror/app/blobs/uploads/1?_state=a", 0},
+		{"resumed chunk", 8, "/v2/mirror/app/blobs/uploads/1?_state=a", 2},
+		{"resumed last chunk", 8, "/v2/mirror/app/blobs/uploads/1?_state=a", 3},
+		{"location without v2", 8, "/uploads/1?_state=a", 0},
+		{"location of an internal host", 8, "http://harbor-v2.corp:5000/v2/mirror/app/blobs/uploads/1?_state=a", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newUploadServer(t, tt.location, tt.failPatch)
+			r := NewRegistry(srv.URL, WithCredential("test", "test"), WithChunkSize(tt.chunkSize))
+
+			if err := r.LayerUpload(context.Background(), "mirror/app", digest.FromBytes(content), bytes.NewReader(content)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(srv.blob, content) {
+				t.Errorf("uploaded %q, want %q", srv.blob, content)
+			}
+			for _, query := range srv.queries {
+				if !strings.Contains(query, "_state=a") {
+					t.Errorf("request with query %q lost the state of the session", query)
+				}
+			}
+			if srv.log.count("DELETE /v2/mirror/app/blobs/uploads/1") > 0 {
+				t.Error("completed upload canceled")
+			}
+		})
+	}
+}
+
+func TestLayerUploadCanceled(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	srv := newUploadServer(t, "/v2/mirror/app/blobs/uploads/1", -1)
+	srv.statusCode = http.StatusNotFound
+	r := NewRegistry(srv.URL, WithCredential("test", "test"), WithChunkSize(8))
+
+	if err := r.LayerUpload(context.Background(), "mirror/app", digest.FromBytes(content), bytes.NewReader(content)); err == nil {
+		t.Fatal("upload of failing chunks succeeded")
+	}
+	if srv.log.count("DELETE /v2/mirror/app/blobs/uploads/1") != 1 {
+		t.Errorf("upload session not canceled, requests %v", srv.log.requests)
+	}
+}
+
+func TestUploadURL(t *testing.T) {
+	tests := []struct {
+		registry string
+		location string
+		want     string
+	}{
+		{"https://registry.test", "/v2/app/blobs/uploads/1?_state=a", "https://registry.test/v2/app/blobs/uploads/1?_state=a"},
+		{"https://registry.test", "http://internal:5000/v2/app/blobs/uploads/1?_state=a", "https://registry.test/v2/app/blobs/uploads/1?_state=a"},
+		{"https://harbor-v2.corp", "/v2/app/blobs/uploads/1", "https://harbor-v2.corp/v2/app/blobs/uploads/1"},
+		{"https://registry.test", "/uploads/1?id=a%2Fb", "https://registry.test/uploads/1?id=a%2Fb"},
+	}
+	for _, tt := range tests {
+		r := &DockerRegistry{URL: tt.registry}
+		location, err := url.Parse(tt.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.uploadURL(location); got != tt.want {
+			t.Errorf("uploadURL(%s) = %s, want %s", tt.location, got, tt.want)
+		}
+	}
+}
+
+// failingReader returns its content, then fails.
+type failingReader struct {
+	content []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.content) == 0 {
+		return 0, errors.New("layer is corrupted")
+	}
+	n := copy(p, r.content)
+	r.content = r.content[n:]
+	return n, nil
+}
+
+func TestLayerUploadAbortedStream(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	for _, chunkSize := range []int64{0, 8} {
+		t.Run(fmt.Sprintf("chunk size %d", chunkSize), func(t *testing.T) {
+			srv := newUploadServer(t, "/v2/mirror/app/blobs/uploads/1", 0)
+			r := NewRegistry(srv.URL, WithCredential("test", "test"), WithChunkSize(chunkSize))
+
+			err := r.LayerUpload(context.Background(), "mirror/app", digest.FromBytes(content), &failingReader{content: content[:12]})
+			if err == nil {
+				t.Fatal("upload of an aborted stream succeeded")
+			}
+			if srv.blob != nil {
+				t.Errorf("blob %q committed", srv.blob)
+			}
+			if srv.log.count("DELETE /v2/mirror/app/blobs/uploads/1") != 1 {
+				t.Errorf("upload session not canceled, requests %v", srv.log.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// maxBurst caps the bytes a stream reads at once, so that a limit is
+	// shared fairly between the streams
+	maxBurst = 256 * 1024
+	// window is the number of seconds the effective rate is averaged over
+	window = 5
+)
+
+// Limiter is a token bucket of bytes per second shared by the streams it
+// throttles. Its limit can be changed while the streams are running.
+type Limiter struct {
+	name    string
+	limiter *rate.Limiter
+
+	mu      sync.Mutex
+	buckets [window]int64
+	seconds [window]int64
+	// first is when the first bytes passed the limiter
+	first time.Time
+}
+
+// NewLimiter creates a limiter of bytesPerSecond, zero does not limit.
+func NewLimiter(name string, bytesPerSecond int64) *Limiter {
+	l := &Limiter{name: name, limiter: rate.NewLimiter(rate.Inf, maxBurst)}
+	l.SetLimit(bytesPerSecond)
+	return l
+}
+
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+// SetLimit changes the limit, zero removes it.
+func (l *Limiter) SetLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		l.limiter.SetLimit(rate.Inf)
+		l.limiter.SetBurst(maxBurst)
+		return
+	}
+	l.limiter.SetLimit(rate.Limit(bytesPerSecond))
+	l.limiter.SetBurst(int(min(bytesPerSecond, maxBurst)))
+}
+
+// Limit returns the limit in bytes per second, zero when there is none.
+func (l *Limiter) Limit() int64 {
+	if l.limiter.Limit() == rate.Inf {
+		return 0
+	}
+	return int64(l.limiter.Limit())
+}
+
+// Rate returns the bytes per second that passed the limiter over the last
+// seconds.
+func (l *Limiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().Unix()
+	var total int64
+	for i, second := range l.seconds {
+		if now-second < window {
+			total += l.buckets[i]
+		}
+	}
+	elapsed := min(time.Since(l.first).Seconds(), window)
+	return float64(total) / max(elapsed, 1)
+}
+
+func (l *Limiter) String() string {
+	if l.Limit() == 0 {
+		return fmt.Sprintf("%s %s/s", l.name, FormatBytes(int64(l.Rate())))
+	}
+	return fmt.Sprintf("%s %s/s of %s/s", l.name, FormatBytes(int64(l.Rate())), FormatBytes(l.Limit()))
+}
+
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	// the burst shrinks when the limit is lowered during a read
+	for left := n; left > 0; {
+		chunk := min(left, l.burst())
+		if err := l.limiter.WaitN(ctx, chunk); err != nil {
+			// the burst shrank since it was read, wait for a smaller chunk
+			if ctx.Err() == nil && chunk > l.burst() {
+				continue
+			}
+			return err
+		}
+		left -= chunk
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.first.IsZero() {
+		l.first = time.Now()
+	}
+	now := time.Now().Unix()
+	i := now % window
+	if l.seconds[i] != now {
+		l.seconds[i], l.buckets[i] = now, 0
+	}
+	l.buckets[i] += int64(n)
+	return nil
+}
+
+// burst is the most bytes the limiter lets through at once.
+func (l *Limiter) burst() int {
+	return max(l.limiter.Burst(), 1)
+}
+
+type reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// Reader throttles r to the limits of all limiters, nil limiters are ignored.
+func Reader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	var active []*Limiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, limiters: active}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for _, l := range r.limiters {
+		p = p[:min(len(p), l.burst())]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if werr := l.wait(r.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+// ParseBytes parses a size such as 512K, 10MB or 1.5GiB into bytes, units
+// are powers of 1024 and a trailing /s is ignored.
+func ParseBytes(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S")
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "IB"), "B")
+	multiplier := int64(1)
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(value, unit) {
+			value = strings.TrimSuffix(value, unit)
+			multiplier = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// FormatBytes formats bytes with the largest unit, powers of 1024, that
+// keeps the number at least 1.
+func FormatBytes(n int64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, unit := float64(n)/1024, 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, units[unit])
+}
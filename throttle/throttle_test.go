@@ -0,0 +1,89 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"512K", 512 << 10, false},
+		{"10MB", 10 << 20, false},
+		{"10mb/s", 10 << 20, false},
+		{"1.5GiB", 3 << 29, false},
+		{" 2 T ", 2 << 40, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"-1M", 0, true},
+		{"10XB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBytes(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseBytes(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		in   int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{10 << 20, "10.0MiB"},
+		{3 << 29, "1.5GiB"},
+		{2048 << 40, "2048.0TiB"},
+	}
+	for _, tt := range tests {
+		if got := FormatBytes(tt.in); got != tt.want {
+			t.Errorf("FormatBytes(%d) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	tests := []struct {
+		limit     int64
+		wantLimit int64
+		wantBurst int
+	}{
+		{10 << 20, 10 << 20, maxBurst},
+		{1024, 1024, 1024},
+		{0, 0, maxBurst},
+		{-1, 0, maxBurst},
+	}
+	l := NewLimiter("test", 0)
+	for _, tt := range tests {
+		l.SetLimit(tt.limit)
+		if l.Limit() != tt.wantLimit || l.burst() != tt.wantBurst {
+			t.Errorf("SetLimit(%d): limit %d, burst %d, want %d, %d", tt.limit, l.Limit(), l.burst(), tt.wantLimit, tt.wantBurst)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	l := NewLimiter("test", 0)
+	data := bytes.Repeat([]byte("isync"), maxBurst)
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, Reader(context.Background(), bytes.NewReader(data), nil, l)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("throttled stream differs")
+	}
+	if l.Rate() == 0 {
+		t.Error("no rate recorded")
+	}
+}